@@ -10,10 +10,13 @@ import (
 	"github.com/theirish81/yamlRef"
 	"github.com/xo/dburl"
 	"gopkg.in/yaml.v2"
+	_ "modernc.org/sqlite"
+	"net/url"
 	"os"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 )
 
 // Config is the root object of the configuration
@@ -24,6 +27,7 @@ import (
 // Rules are the routes
 // OpenAPI is the OpenAPI way tof configuring rules
 // Prometheus is the Prometheus configuration object
+// Scripts is the configuration of the JavaScript modules shared by the scripts
 type Config struct {
 	Variables  StringMap                 `yaml:"variables"`
 	Network    Network                   `yaml:"network"`
@@ -32,6 +36,7 @@ type Config struct {
 	Rules      DomainsMap                `yaml:"rules"`
 	OpenAPI    map[string]*OpenAPIConfig `yaml:"openAPI"`
 	Prometheus *PrometheusConfig         `yaml:"prometheus"`
+	Scripts    ScriptsConfig             `yaml:"scripts"`
 }
 
 // DomainsMap is a map of domain=path objects
@@ -100,6 +105,21 @@ type OpenAPIConfig struct {
 // Request is the request transformation pipeline
 // Response is the response transformation pipeline
 // Pattern is the pattern that matches the path of the URL, in the form of a regexp string
+// Database is the configuration of the queries, assuming this rule is using a DBTripper
+// File is the configuration of the file server, assuming this rule is using a file origin
+// Mock is the configuration of the responses, assuming this rule is using a mock origin
+// GRPC is the configuration of the gRPC methods, assuming this rule is using a gRPC origin
+// WebSocket is the configuration of the message pipelines, assuming this rule is using a websocket origin
+// Exec is the configuration of the executable, assuming this rule is using an exec origin
+// FCGI is the configuration of the FastCGI application, assuming this rule is using a FastCGI origin
+// Streaming if set to true, marks the responses as streams, which are flushed to the client as they're read and never
+// expanded. Server-Sent Events responses are always treated as streams
+// Split is the optional traffic split configuration, routing portions of the traffic to alternate origins
+// Timeout is the maximum duration of the whole transaction, as a duration string. Leave empty for no timeout
+// MaxBodySize is the maximum size of the request body, in bytes. Overrides the global setting when greater than zero
+// MaxExpandSize is the maximum size of a body that can be expanded, in bytes. Overrides the global setting when
+// greater than zero
+// _timeout is the parsed version of Timeout
 // _pattern is the path component of the pattern. This is derived from the path pattern, key of the rule
 // _patternMethod is the method component of the pattern, assuming it's there. This is derived from the path pattern
 // key of the rule
@@ -111,6 +131,19 @@ type Rule struct {
 	Response       ResponseConfig `yaml:"response"`
 	Pattern        string         `yaml:"pattern"`
 	AllowedMethods []string       `yaml:"allowedMethods"`
+	MaxBodySize    int64          `yaml:"maxBodySize"`
+	MaxExpandSize  int64          `yaml:"maxExpandSize"`
+	Timeout        string         `yaml:"timeout"`
+	Streaming      bool           `yaml:"streaming"`
+	Split          *SplitConfig   `yaml:"split"`
+	Mock           *MockConfig    `yaml:"mock"`
+	File           *FileConfig    `yaml:"file"`
+	Database       *DBConfig      `yaml:"database"`
+	GRPC           *GRPCConfig    `yaml:"grpc"`
+	WebSocket      *WSConfig      `yaml:"websocket"`
+	Exec           *ExecConfig    `yaml:"exec"`
+	FCGI           *FCGIConfig    `yaml:"fcgi"`
+	_timeout       time.Duration
 	_pattern       string
 	_patternMethod string
 	oa             *openapi3.T
@@ -119,6 +152,24 @@ type Rule struct {
 	db             *sqlx.DB
 }
 
+// GetMaxBodySize returns the maximum request body size for the rule, falling back to the global setting.
+// Zero means no limit
+func (r *Rule) GetMaxBodySize() int64 {
+	if r != nil && r.MaxBodySize > 0 {
+		return r.MaxBodySize
+	}
+	return config.Network.Downstream.MaxBodySize
+}
+
+// GetMaxExpandSize returns the maximum size of a body that can be expanded for the rule, falling back to the global
+// setting. Zero means no limit
+func (r *Rule) GetMaxExpandSize() int64 {
+	if r != nil && r.MaxExpandSize > 0 {
+		return r.MaxExpandSize
+	}
+	return config.Network.Downstream.MaxExpandSize
+}
+
 // RequestConfig is the configuration of the request pipeline
 // Transformers is an array of transformer configurations
 // Sidecars is an array of sidecar configurations
@@ -212,9 +263,20 @@ type Network struct {
 // Downstream is the downstream configuration
 // Port is the port number we should listen on
 // Tls is the secure connection configuration
+// MaxBodySize is the maximum size of the request body, in bytes. Larger requests are rejected with 413. Zero means
+// no limit
+// MaxExpandSize is the maximum size of a body that can be expanded, in bytes. Larger bodies are streamed without
+// expansion. Zero means no limit
+// FlushInterval is how often the response bodies are flushed to the client while being copied, as a duration string.
+// Leave empty to flush only at the end. Streaming responses are always flushed immediately
+// _flushInterval is the parsed version of FlushInterval
 type Downstream struct {
-	Port int   `yaml:"port"`
-	Tls  []Tls `yaml:"tls"`
+	Port           int    `yaml:"port"`
+	Tls            []Tls  `yaml:"tls"`
+	MaxBodySize    int64  `yaml:"maxBodySize"`
+	MaxExpandSize  int64  `yaml:"maxExpandSize"`
+	FlushInterval  string `yaml:"flushInterval"`
+	_flushInterval time.Duration
 }
 
 // Upstream is the upstream configuration
@@ -249,6 +311,12 @@ type PrometheusConfig struct {
 	Path string
 }
 
+// ScriptsConfig is the configuration of the JavaScript modules shared by the scripts
+// Dir is the directory the modules are required from. If empty, the scripts can't require modules
+type ScriptsConfig struct {
+	Dir string `yaml:"dir"`
+}
+
 // LoadConfig loads the configuration
 func LoadConfig(file string) Config {
 	config := Config{}
@@ -290,6 +358,21 @@ func (c *Config) Init() {
 	if c.OpenAPI != nil {
 		c.Rules = MergeRules(c.Rules, OpenAPI2Rules(c.OpenAPI))
 	}
+	if c.Network.Downstream.FlushInterval != "" {
+		var err error
+		c.Network.Downstream._flushInterval, err = time.ParseDuration(c.Network.Downstream.FlushInterval)
+		if err != nil {
+			log.Fatal("Downstream flush interval is not in the right format", err, nil)
+		}
+	}
+	// The modules must be available before the scripts are compiled
+	if c.Scripts.Dir != "" {
+		var err error
+		scriptModules, err = NewScriptModules(c.Scripts.Dir)
+		if err != nil {
+			log.Fatal("Could not load the scripts directory", err, AnyMap{"dir": c.Scripts.Dir})
+		}
+	}
 	// For every domain definition
 	for domain, topRule := range c.Rules {
 		// For every rule within the domain definition
@@ -302,6 +385,19 @@ func (c *Config) Init() {
 			if err != nil {
 				log.Fatal("Could not parse origin", err, AnyMap{"origin": rule.Origin})
 			}
+			// If the rule has a timeout, we parse it
+			if rule.Timeout != "" {
+				rule._timeout, err = time.ParseDuration(rule.Timeout)
+				if err != nil {
+					log.Fatal("Rule timeout is not in the right format", err, AnyMap{"pattern": rule.Pattern})
+				}
+			}
+			// If the rule splits the traffic, we initialize the variants
+			if rule.Split != nil {
+				if err = rule.Split.Init(); err != nil {
+					log.Fatal("Could not initialize the traffic split", err, AnyMap{"pattern": rule.Pattern})
+				}
+			}
 			// Before, Rule and After request transformers configuration are merged into one array...
 			mergedReqTransformers := append(append(c.Before.Request.Transformers, rule.Request.Transformers...), c.After.Request.Transformers...)
 			// ... and then transformers get initialized
@@ -329,23 +425,94 @@ func (c *Config) Init() {
 			rule.Response._sidecars = NewResponseSidecars(&mergedResSidecars)
 
 			// If the origin is a URI to a DB...
-			if hasPrefixes(rule.Origin, []string{"postgres://", "mysql://"}) {
+			if hasPrefixes(rule.Origin, []string{"postgres://", "mysql://", "sqlite://"}) {
 				// Parse the URI
-				databaseUrl, err := dburl.Parse(rule.Origin)
+				driver, dsn, err := parseDatabaseURI(rule.Origin)
 				if err != nil {
 					log.Fatal("Could not parse the database URI", err, nil)
 				}
+				if err = rule.Database.Init(); err != nil {
+					log.Fatal("Could not initialize the database origin", err, AnyMap{"pattern": rule.Pattern})
+				}
 				// Open the connection and store the reference
-				rule.db, err = sqlx.Open(databaseUrl.Driver, databaseUrl.DSN)
+				rule.db, err = rule.Database.Open(driver, dsn)
 				if err != nil {
 					log.Fatal("Could not connect to the database", err, nil)
 				}
+				// The database may become reachable later, unless it's required at startup
+				if err = rule.Database.Ping(rule.db); err != nil {
+					if rule.Database != nil && rule.Database.RequireConnection {
+						log.Fatal("Could not reach the database", err, AnyMap{"pattern": rule.Pattern})
+					}
+					log.Warn("Could not reach the database", err, AnyMap{"pattern": rule.Pattern})
+				}
+				if prom != nil {
+					prom.RegisterDB(domain, rule.Pattern, rule.db.DB)
+				}
+			}
+			// If the origin is a gRPC server, we load the descriptors and connect
+			if hasPrefixes(rule.Origin, []string{"grpc://", "grpcs://"}) {
+				if err = rule.GRPC.Init(rule.Origin); err != nil {
+					log.Fatal("Could not initialize the gRPC origin", err, AnyMap{"pattern": rule.Pattern})
+				}
+			}
+			// If the rule has websocket message pipelines, we initialize their transformers and sidecars
+			if rule.WebSocket != nil {
+				if err = rule.WebSocket.Init(); err != nil {
+					log.Fatal("Could not initialize the websocket pipelines", err, AnyMap{"pattern": rule.Pattern})
+				}
+			}
+			// If the origin is an executable, we make sure it exists and compile its arguments allowlist
+			if strings.HasPrefix(rule.Origin, "exec://") {
+				if rule.Exec == nil {
+					rule.Exec = &ExecConfig{}
+				}
+				if err = rule.Exec.Init(rule.Origin); err != nil {
+					log.Fatal("Could not initialize the exec origin", err, AnyMap{"pattern": rule.Pattern})
+				}
+			}
+			// If the origin is a FastCGI application, we parse its address
+			if hasPrefixes(rule.Origin, []string{"fcgi://", "fcgi+unix://"}) {
+				if err = rule.FCGI.Init(rule.Origin); err != nil {
+					log.Fatal("Could not initialize the FastCGI origin", err, AnyMap{"pattern": rule.Pattern})
+				}
+			}
+			// If the origin is a mock, we load its templates
+			if strings.HasPrefix(rule.Origin, "mock://") {
+				if err = rule.Mock.Init(); err != nil {
+					log.Fatal("Could not initialize the mock origin", err, AnyMap{"pattern": rule.Pattern})
+				}
 			}
 			log.Info("route registered", AnyMap{"pattern": rule.Pattern, "domain": domain})
 		}
 	}
 }
 
+// parseDatabaseURI will convert a database URI into a driver name and a DSN.
+// SQLite URIs are handled like file origins, so sqlite://path/to/file.db is a relative path, sqlite:///path/to/file.db
+// is an absolute path and sqlite:///:memory: is an in-memory database
+func parseDatabaseURI(uri string) (string, string, error) {
+	if strings.HasPrefix(uri, "sqlite://") {
+		sqliteUrl, err := url.Parse(uri)
+		if err != nil {
+			return "", "", err
+		}
+		dsn := sqliteUrl.Host + sqliteUrl.Path
+		if dsn == "/:memory:" {
+			dsn = ":memory:"
+		}
+		if sqliteUrl.RawQuery != "" {
+			dsn += "?" + sqliteUrl.RawQuery
+		}
+		return "sqlite", dsn, nil
+	}
+	databaseUrl, err := dburl.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	return databaseUrl.Driver, databaseUrl.DSN, nil
+}
+
 // LoggerConfig is the logger configuration
 type LoggerConfig struct {
 	Level  string `yaml:"level"`
@@ -20,6 +20,7 @@ var config Config
 var addresser = NewIPAddresser()
 var prom *Prometheus
 var template RPTemplate
+var scriptModules *ScriptModules
 
 func main() {
 	configFilePath := flag.String("c", "", "Path of the main configuration file")
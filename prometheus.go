@@ -1,20 +1,25 @@
 package main
 
 import (
+	"database/sql"
 	"github.com/prometheus/client_golang/prometheus"
 	"sync"
 )
 
 // Prometheus is the RedPlant configuration for Prometheus
 // InternalErrorsCounter is a global Prometheus counter for errors
+// TimeoutsCounter is a global Prometheus counter for transactions exceeding the rule timeout
 // CustomCounters is a map of counters transformers and sidecars can use
 // CustomSummaries is a map of summaries transformers and sidecars can use
+// DBStats is the collector of the connection pool statistics of the database origins
 // customCounterCreationMutex will make sure that no duplicate counters will be created
 // customSummaryCreationMutex will make sure that no duplicate summaries will be created
 type Prometheus struct {
 	InternalErrorsCounter      prometheus.Counter
+	TimeoutsCounter            prometheus.Counter
 	CustomCounters             map[string]prometheus.Counter
 	CustomSummaries            map[string]prometheus.Summary
+	DBStats                    *DBStatsCollector
 	customCounterCreationMutex sync.Mutex
 	customSummaryCreationMutex sync.Mutex
 }
@@ -29,6 +34,16 @@ func NewPrometheus() *Prometheus {
 	})
 	prom.InternalErrorsCounter = iec
 	_ = prometheus.Register(iec)
+	tc := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "redplant",
+		Name:      "timeouts",
+		Help:      "counting transactions that exceeded the rule timeout",
+	})
+	prom.TimeoutsCounter = tc
+	_ = prometheus.Register(tc)
+
+	prom.DBStats = NewDBStatsCollector()
+	_ = prometheus.Register(prom.DBStats)
 
 	prom.CustomCounters = make(map[string]prometheus.Counter)
 	prom.CustomSummaries = make(map[string]prometheus.Summary)
@@ -67,3 +82,75 @@ func (p *Prometheus) CustomSummary(name string) prometheus.Summary {
 	_ = prometheus.Register(p.CustomSummaries[name])
 	return p.CustomSummaries[name]
 }
+
+// RegisterDB will export the connection pool statistics of the database of a rule
+func (p *Prometheus) RegisterDB(domain string, pattern string, db *sql.DB) {
+	p.DBStats.Add(domain, pattern, db)
+}
+
+// dbStatsDescription describes a connection pool statistic, and how to extract it
+type dbStatsDescription struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(stats sql.DBStats) float64
+}
+
+// DBStatsCollector is a Prometheus collector for the connection pool statistics of the database origins.
+// The statistics are labelled by domain and rule pattern
+type DBStatsCollector struct {
+	dbs          map[[2]string]*sql.DB
+	descriptions []dbStatsDescription
+	mutex        sync.Mutex
+}
+
+// NewDBStatsCollector is the constructor for DBStatsCollector
+func NewDBStatsCollector() *DBStatsCollector {
+	labels := []string{"domain", "rule"}
+	description := func(name string, help string, valueType prometheus.ValueType, value func(stats sql.DBStats) float64) dbStatsDescription {
+		return dbStatsDescription{desc: prometheus.NewDesc("redplant_db_"+name, help, labels, nil), valueType: valueType, value: value}
+	}
+	return &DBStatsCollector{dbs: make(map[[2]string]*sql.DB), descriptions: []dbStatsDescription{
+		description("max_open_connections", "maximum number of open connections to the database", prometheus.GaugeValue,
+			func(stats sql.DBStats) float64 { return float64(stats.MaxOpenConnections) }),
+		description("open_connections", "number of established connections, both in use and idle", prometheus.GaugeValue,
+			func(stats sql.DBStats) float64 { return float64(stats.OpenConnections) }),
+		description("in_use_connections", "number of connections currently in use", prometheus.GaugeValue,
+			func(stats sql.DBStats) float64 { return float64(stats.InUse) }),
+		description("idle_connections", "number of idle connections", prometheus.GaugeValue,
+			func(stats sql.DBStats) float64 { return float64(stats.Idle) }),
+		description("wait_count", "total number of connections waited for", prometheus.CounterValue,
+			func(stats sql.DBStats) float64 { return float64(stats.WaitCount) }),
+		description("wait_duration_seconds", "total time blocked waiting for a new connection", prometheus.CounterValue,
+			func(stats sql.DBStats) float64 { return stats.WaitDuration.Seconds() }),
+		description("max_idle_closed", "total number of connections closed due to the maximum idle connections", prometheus.CounterValue,
+			func(stats sql.DBStats) float64 { return float64(stats.MaxIdleClosed) }),
+		description("max_idle_time_closed", "total number of connections closed due to the maximum idle time", prometheus.CounterValue,
+			func(stats sql.DBStats) float64 { return float64(stats.MaxIdleTimeClosed) }),
+		description("max_lifetime_closed", "total number of connections closed due to the maximum lifetime", prometheus.CounterValue,
+			func(stats sql.DBStats) float64 { return float64(stats.MaxLifetimeClosed) }),
+	}}
+}
+
+// Add will add a database to the collector
+func (c *DBStatsCollector) Add(domain string, pattern string, db *sql.DB) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dbs[[2]string{domain, pattern}] = db
+}
+
+func (c *DBStatsCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, description := range c.descriptions {
+		descs <- description.desc
+	}
+}
+
+func (c *DBStatsCollector) Collect(metrics chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for labels, db := range c.dbs {
+		stats := db.Stats()
+		for _, description := range c.descriptions {
+			metrics <- prometheus.MustNewConstMetric(description.desc, description.valueType, description.value(stats), labels[0], labels[1])
+		}
+	}
+}
@@ -29,16 +29,43 @@ func SetupRouter() *mux.Router {
 				wrapper.Err = errors.New("method_not_allowed")
 				return
 			}
-			wrapper.ExpandRequestIfNeeded()
+			if err := wrapper.LimitRequestBody(); err != nil {
+				wrapper.Err = err
+				return
+			}
+			if err := wrapper.ExpandRequestIfNeeded(); err != nil {
+				wrapper.Err = err
+				return
+			}
 			wrapper.Rule.Request._sidecars.Run(wrapper.Clone())
 			handleURL(wrapper.Rule, req)
 			wrapper.Metrics.ReqTransStart = time.Now()
 			_, err := wrapper.Rule.Request._transformers.Transform(wrapper)
 			wrapper.Metrics.ReqTransEnd = time.Now()
 			wrapper.Err = err
+			// the traffic split happens after the transformers, so that tags and identities can be taken into account
+			if err == nil && wrapper.Rule.Split != nil {
+				handleSplit(wrapper, req)
+			}
 		},
 		// Custom  error handler
 		ErrorHandler: func(writer http.ResponseWriter, request *http.Request, err error) {
+			// a body exceeding the maximum size may be detected while streaming it to the origin
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				err = errors.New("body_too_large")
+			}
+			// if the transaction deadline has been exceeded, whatever the error, it's a timeout. Hijacked connections
+			// can't be written to anymore, so their errors are left as they are
+			if wrapper := GetWrapper(request); wrapper != nil && !wrapper.Hijacked && wrapper.TimedOut() {
+				err = errors.New("timeout")
+			}
+			// a script may have ended the transaction with its own response
+			var scriptResponse *ScriptResponse
+			if errors.As(err, &scriptResponse) {
+				scriptResponse.Write(writer)
+				return
+			}
 			wrapper := GetWrapper(request)
 			if wrapper != nil {
 				// If the connection has been hijacked, we can't operate on the response anymore.
@@ -54,10 +81,20 @@ func SetupRouter() *mux.Router {
 				}
 			}
 			switch err.Error() {
+			case "bad_request":
+				writer.WriteHeader(400)
 			case "no_mapping":
 				writer.WriteHeader(404)
 			case "method_not_allowed":
 				writer.WriteHeader(405)
+			case "body_too_large":
+				writer.WriteHeader(413)
+			case "timeout":
+				if prom != nil {
+					prom.TimeoutsCounter.Inc()
+				}
+				log.Warn("Transaction timed out", nil, AnyMap{"url": request.URL.String()})
+				writer.WriteHeader(504)
 			default:
 				if prom != nil {
 					prom.InternalErrorsCounter.Inc()
@@ -68,6 +105,8 @@ func SetupRouter() *mux.Router {
 		},
 		// Custom transport
 		Transport: configTransport(),
+		// Responses are flushed periodically. Streaming responses are flushed immediately
+		FlushInterval: config.Network.Downstream._flushInterval,
 		// Post trip response modification
 		ModifyResponse: func(response *http.Response) error {
 			wrapper := GetWrapper(response.Request)
@@ -83,7 +122,17 @@ func SetupRouter() *mux.Router {
 				for k, v := range wrapper.ApplyHeaders {
 					wrapper.Response.Header.Set(k, v[0])
 				}
-				wrapper.ExpandResponseIfNeeded()
+				if wrapper.IsStreamingResponse() {
+					// streams are meant to outlive the transaction deadline
+					wrapper.LiftDeadline()
+					wrapper.Tags = append(wrapper.Tags, "response_streaming")
+					// the reverse proxy flushes every write when the content length is unknown
+					response.ContentLength = -1
+					response.Header.Del("content-length")
+					wrapper.ObserveEvents()
+				} else {
+					wrapper.ExpandResponseIfNeeded()
+				}
 				wrapper.Metrics.ResTransStart = time.Now()
 				_, err := wrapper.Rule.Response._transformers.Transform(wrapper)
 				if err != nil {
@@ -103,6 +152,7 @@ func SetupRouter() *mux.Router {
 			func(rule *Rule) {
 				route := hostRoute.HandleFunc(rule._pattern, func(writer http.ResponseWriter, request *http.Request) {
 					request = ReqWithContext(request, writer, rule)
+					defer GetWrapper(request).Release()
 					reverseProxy.ServeHTTP(writer, request)
 				})
 				if rule._patternMethod != "" {
@@ -137,6 +187,39 @@ func hasMethod(wrapper *APIWrapper) bool {
 	return true
 }
 
+// handleSplit chooses the traffic split variant for the transaction. If an alternate origin is chosen, the URL is
+// changed accordingly. Either way, the name of the variant is applied as a tag
+func handleSplit(wrapper *APIWrapper, req *http.Request) {
+	variant := wrapper.Rule.Split.Select(wrapper)
+	if variant == nil {
+		wrapper.Variant = wrapper.Rule.Split.Primary
+	} else {
+		wrapper.Variant = variant.Name
+		req.URL = replaceOrigin(req.URL, wrapper.Rule.Origin, variant._origin)
+		req.Host = req.URL.Host
+	}
+	wrapper.Tags = append(wrapper.Tags, wrapper.Variant)
+}
+
+// replaceOrigin will return a copy of the provided upstream URL, where the primary origin has been replaced with the
+// provided origin. The rest of the path and the query are preserved
+func replaceOrigin(upstreamURL *url.URL, primaryOrigin string, origin *url.URL) *url.URL {
+	newUrl := *upstreamURL
+	newUrl.Scheme = origin.Scheme
+	newUrl.Host = origin.Host
+	reqPath := newUrl.Path
+	if parsedOrigin, err := url.Parse(primaryOrigin); err == nil {
+		reqPath = strings.TrimPrefix(reqPath, parsedOrigin.Path)
+	}
+	// we don't like colliding slashes
+	if strings.HasSuffix(origin.Path, "/") && strings.HasPrefix(reqPath, "/") {
+		reqPath = reqPath[1:]
+	}
+	newUrl.Path = origin.Path + reqPath
+	newUrl.RawPath = ""
+	return &newUrl
+}
+
 // handleURL transforms the URL based on the rules
 func handleURL(rule *Rule, req *http.Request) {
 	newUrl, _ := url.Parse(rule.Origin)
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ScriptResponse is a response produced by a script or a plugin, which short-circuits the transaction
+type ScriptResponse struct {
+	Status  int
+	Headers http.Header
+	Body    []byte
+}
+
+func (r *ScriptResponse) Error() string {
+	return "script_response"
+}
+
+// Write writes the response to the client
+func (r *ScriptResponse) Write(writer http.ResponseWriter) {
+	for k, v := range r.Headers {
+		writer.Header()[k] = v
+	}
+	writer.Header().Set("content-length", strconv.Itoa(len(r.Body)))
+	writer.WriteHeader(r.Status)
+	_, _ = writer.Write(r.Body)
+}
+
+// scriptAPI is the JavaScript API exposed to a script, for a transaction
+// response is set if the script produced a response
+type scriptAPI struct {
+	wrapper  *APIWrapper
+	log      *STLogHelper
+	response *ScriptResponse
+}
+
+// Globals returns the objects and functions exposed to the script. The response object is null on the request side.
+// The wrapper is exposed for the scripts written before this API, through the scriptFieldMapper
+func (a *scriptAPI) Globals() map[string]any {
+	globals := map[string]any{
+		"wrapper":     a.wrapper,
+		"request":     a.requestObject(),
+		"response":    nil,
+		"transaction": a.transactionObject(),
+		"log":         a.logObject(),
+		"metrics":     a.metricsObject(),
+		"respond":     a.respond,
+	}
+	if a.wrapper.Response != nil {
+		globals["response"] = a.responseObject()
+	}
+	return globals
+}
+
+// requestReader returns the object reading the request
+func (a *scriptAPI) requestReader() map[string]any {
+	request := a.wrapper.Request
+	object := headerReaders(request.Header)
+	object["getMethod"] = func() string {
+		return request.Method
+	}
+	object["getPath"] = func() string {
+		return request.URL.Path
+	}
+	object["getQuery"] = func(name string) string {
+		return request.URL.Query().Get(name)
+	}
+	object["query"] = func() map[string]string {
+		res := map[string]string{}
+		for k, v := range request.URL.Query() {
+			res[k] = v[0]
+		}
+		return res
+	}
+	object["getBody"] = func() string {
+		return string(request.ExpandedBody)
+	}
+	object["getJSON"] = func() (any, error) {
+		return parseScriptJSON(request.ParsedBody, request.ExpandedBody)
+	}
+	return object
+}
+
+// requestObject returns the object reading and modifying the request
+func (a *scriptAPI) requestObject() map[string]any {
+	request := a.wrapper.Request
+	object := a.requestReader()
+	addHeaderSetters(object, request.Header)
+	object["setPath"] = func(path string) {
+		request.URL.Path = path
+		request.URL.RawPath = ""
+	}
+	object["setQuery"] = func(name string, value string) {
+		query := request.URL.Query()
+		query.Set(name, value)
+		request.URL.RawQuery = query.Encode()
+	}
+	object["deleteQuery"] = func(name string) {
+		query := request.URL.Query()
+		query.Del(name)
+		request.URL.RawQuery = query.Encode()
+	}
+	object["setBody"] = func(body string) {
+		request.SetBody([]byte(body))
+	}
+	object["setJSON"] = func(value any) error {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("content-type", "application/json")
+		request.ParsedBody = value
+		request.SetBody(data)
+		return nil
+	}
+	return object
+}
+
+// responseReader returns the object reading the response
+func (a *scriptAPI) responseReader() map[string]any {
+	response := a.wrapper.Response
+	object := headerReaders(response.Header)
+	object["getStatus"] = func() int {
+		return response.StatusCode
+	}
+	object["getBody"] = func() string {
+		return string(response.ExpandedBody)
+	}
+	object["getJSON"] = func() (any, error) {
+		return parseScriptJSON(response.ParsedBody, response.ExpandedBody)
+	}
+	return object
+}
+
+// responseObject returns the object reading and modifying the response
+func (a *scriptAPI) responseObject() map[string]any {
+	response := a.wrapper.Response
+	object := a.responseReader()
+	addHeaderSetters(object, response.Header)
+	object["setStatus"] = func(status int) error {
+		if err := checkScriptStatus(status); err != nil {
+			return err
+		}
+		response.StatusCode = status
+		return nil
+	}
+	object["setBody"] = func(body string) {
+		response.SetBody([]byte(body))
+	}
+	object["setJSON"] = func(value any) error {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		response.Header.Set("content-type", "application/json")
+		response.ParsedBody = value
+		response.SetBody(data)
+		return nil
+	}
+	return object
+}
+
+// headerReaders returns the functions reading the given headers
+func headerReaders(header http.Header) map[string]any {
+	return map[string]any{
+		"getHeader": func(name string) string {
+			return header.Get(name)
+		},
+		"headers": func() map[string]string {
+			return joinHeaders(header)
+		},
+	}
+}
+
+// joinHeaders returns the headers as a map. Multiple values are joined by a comma
+func joinHeaders(header http.Header) map[string]string {
+	res := map[string]string{}
+	for k, v := range header {
+		res[k] = strings.Join(v, ", ")
+	}
+	return res
+}
+
+// addHeaderSetters adds the functions modifying the given headers to the object
+func addHeaderSetters(object map[string]any, header http.Header) {
+	object["setHeader"] = func(name string, value string) {
+		header.Set(name, value)
+	}
+	object["deleteHeader"] = func(name string) {
+		header.Del(name)
+	}
+}
+
+// parseScriptJSON returns the parsed body if present, or parses the expanded body
+func parseScriptJSON(parsedBody any, expandedBody []byte) (any, error) {
+	if parsedBody != nil {
+		return parsedBody, nil
+	}
+	if len(expandedBody) == 0 {
+		return nil, errors.New("the body is empty or has not been expanded")
+	}
+	var res any
+	err := json.Unmarshal(expandedBody, &res)
+	return res, err
+}
+
+// transactionReader returns the object reading the transaction metadata, tags and variables
+func (a *scriptAPI) transactionReader() map[string]any {
+	wrapper := a.wrapper
+	return map[string]any{
+		"id":       wrapper.ID,
+		"ip":       wrapper.RealIP,
+		"username": wrapper.Username,
+		"tags": func() []string {
+			return wrapper.Tags
+		},
+		"hasTag": func(tag string) bool {
+			return stringInArray(tag, wrapper.Tags)
+		},
+		"getVariable": func(name string) string {
+			if wrapper.Variables == nil {
+				return ""
+			}
+			return (*wrapper.Variables)[name]
+		},
+	}
+}
+
+// transactionObject returns the object reading and modifying the transaction metadata, tags and variables
+func (a *scriptAPI) transactionObject() map[string]any {
+	wrapper := a.wrapper
+	object := a.transactionReader()
+	object["addTag"] = func(tag string) {
+		wrapper.Tags = append(wrapper.Tags, tag)
+	}
+	object["setVariable"] = func(name string, value string) {
+		// the variables may be shared with the global configuration, so they're copied before being changed
+		variables := StringMap{}
+		if wrapper.Variables != nil {
+			for k, v := range *wrapper.Variables {
+				variables[k] = v
+			}
+		}
+		variables[name] = value
+		wrapper.Variables = &variables
+	}
+	return object
+}
+
+// logObject returns the object logging through the logger of the component running the script
+func (a *scriptAPI) logObject() map[string]any {
+	return map[string]any{
+		"debug": func(message string, meta map[string]any) {
+			a.log.LogWithMeta(message, a.wrapper, meta, a.log.Debug)
+		},
+		"info": func(message string, meta map[string]any) {
+			a.log.LogWithMeta(message, a.wrapper, meta, a.log.Info)
+		},
+		"warn": func(message string, meta map[string]any) {
+			a.log.LogWithErrorMeta(message, nil, a.wrapper, meta, a.log.Warn)
+		},
+		"error": func(message string, meta map[string]any) {
+			a.log.LogWithErrorMeta(message, nil, a.wrapper, meta, a.log.Error)
+		},
+	}
+}
+
+// metricsObject returns the object emitting Prometheus counters
+func (a *scriptAPI) metricsObject() map[string]any {
+	return map[string]any{
+		"inc": func(name string) {
+			a.log.PrometheusCounterInc(name)
+		},
+		"add": func(name string, value float64) error {
+			// counters can only go up, and Prometheus panics otherwise
+			if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+				return errors.New("invalid counter increment: " + strconv.FormatFloat(value, 'f', -1, 64))
+			}
+			a.log.PrometheusCounterAdd(name, int(value))
+			return nil
+		},
+	}
+}
+
+// respond makes the transaction end with the given response. A body that is not a string is encoded in JSON
+func (a *scriptAPI) respond(status int, body any, headers map[string]string) error {
+	if err := checkScriptStatus(status); err != nil {
+		return err
+	}
+	response := ScriptResponse{Status: status, Headers: http.Header{}}
+	for k, v := range headers {
+		response.Headers.Set(k, v)
+	}
+	switch data := body.(type) {
+	case nil:
+	case string:
+		response.Body = []byte(data)
+	default:
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		response.Body = encoded
+		if response.Headers.Get("content-type") == "" {
+			response.Headers.Set("content-type", "application/json")
+		}
+	}
+	a.response = &response
+	return nil
+}
+
+// scriptHiddenWrapperFields are the fields of the wrapper the scripts can't reach, as they're internals of the
+// transaction
+var scriptHiddenWrapperFields = []string{"Context", "ResponseWriter", "Rule", "Metrics", "Err"}
+
+// scriptFieldMapper exposes the Go values to the scripts with their Go names, as goja does by default, except for the
+// methods and the internal fields of the wrapper. The `wrapper` global is deprecated, and is only kept so that the
+// scripts written before the JavaScript API keep working
+type scriptFieldMapper struct{}
+
+func (scriptFieldMapper) FieldName(t reflect.Type, f reflect.StructField) string {
+	if t == reflect.TypeOf(APIWrapper{}) && stringInArray(f.Name, scriptHiddenWrapperFields) {
+		return ""
+	}
+	return f.Name
+}
+
+func (scriptFieldMapper) MethodName(t reflect.Type, m reflect.Method) string {
+	if t == reflect.TypeOf(APIWrapper{}) || t == reflect.TypeOf(&APIWrapper{}) {
+		return ""
+	}
+	return m.Name
+}
+
+// checkScriptStatus returns an error if the status code set by a script can't be written to the client
+func checkScriptStatus(status int) error {
+	if status < 100 || status > 599 {
+		return errors.New("invalid status code: " + strconv.Itoa(status))
+	}
+	return nil
+}
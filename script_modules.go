@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"github.com/dop251/goja"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scriptRequireProgram creates the require function of a run, given the Go functions resolving and loading the
+// modules. The modules run from JavaScript, so that interruptions can't be caught by the scripts
+var scriptRequireProgram = goja.MustCompile("require", `(function (resolve, load) {
+	var cache = {};
+	function requireFrom(base) {
+		return function (name) {
+			var path = resolve(String(name), base);
+			if (Object.prototype.hasOwnProperty.call(cache, path)) {
+				return cache[path].exports;
+			}
+			var module = {exports: {}};
+			cache[path] = module;
+			load(path).call(undefined, module.exports, requireFrom(path), module);
+			return module.exports;
+		};
+	}
+	return requireFrom('');
+})`, false)
+
+// ScriptModules loads the CommonJS modules shared by the scripts, from a root directory. Modules are compiled once and
+// compiled again when their file changes
+// root is the absolute path of the scripts directory
+// modules are the compiled modules, by path
+type ScriptModules struct {
+	root    string
+	modules map[string]*scriptModule
+	lock    sync.RWMutex
+}
+
+// scriptModule is a compiled module
+// modTime and size identify the version of the file that has been compiled
+type scriptModule struct {
+	program *goja.Program
+	modTime time.Time
+	size    int64
+}
+
+// NewScriptModules is the constructor for ScriptModules
+func NewScriptModules(root string) (*ScriptModules, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	// the root is resolved, so that the modules can be compared with it once their symbolic links are resolved
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("not a directory: " + root)
+	}
+	return &ScriptModules{root: root, modules: map[string]*scriptModule{}}, nil
+}
+
+// Resolve returns the path of the module with the given name. Names starting with ./ or ../ are relative to the
+// requiring module, if any. Other names are relative to the root. The .js extension is optional. Modules outside the
+// root can't be required
+func (m *ScriptModules) Resolve(name string, base string) (string, error) {
+	dir := m.root
+	if base != "" && (strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../")) {
+		dir = filepath.Dir(base)
+	}
+	path := filepath.Join(dir, name)
+	if filepath.Ext(path) != ".js" {
+		path += ".js"
+	}
+	if !strings.HasPrefix(path, m.root+string(filepath.Separator)) {
+		return "", errors.New("module outside the scripts directory: " + name)
+	}
+	// symbolic links are not allowed to escape the root either
+	if resolved, err := filepath.EvalSymlinks(path); err == nil && !isWithin(m.root, resolved) {
+		return "", errors.New("module outside the scripts directory: " + name)
+	}
+	return path, nil
+}
+
+// Load returns the compiled module at the given path. The module is compiled if it's not been compiled yet, or if its
+// file changed since it was
+func (m *ScriptModules) Load(path string) (*goja.Program, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	module, ok := m.modules[path]
+	m.lock.RUnlock()
+	if ok && module.modTime.Equal(info.ModTime()) && module.size == info.Size() {
+		return module.program, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// the module is wrapped in a function, as in CommonJS. The line numbers of the errors are kept
+	program, err := goja.Compile(path, "(function (exports, require, module) {"+string(data)+"\n})", false)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	m.modules[path] = &scriptModule{program: program, modTime: info.ModTime(), size: info.Size()}
+	m.lock.Unlock()
+	return program, nil
+}
+
+// Require returns the require function for a run in the given runtime. Each module is evaluated once per run
+func (m *ScriptModules) Require(vm *goja.Runtime) (goja.Value, error) {
+	factory, err := vm.RunProgram(scriptRequireProgram)
+	if err != nil {
+		return nil, err
+	}
+	create, _ := goja.AssertFunction(factory)
+	load := func(path string) (goja.Value, error) {
+		program, err := m.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		return vm.RunProgram(program)
+	}
+	return create(goja.Undefined(), vm.ToValue(m.Resolve), vm.ToValue(load))
+}
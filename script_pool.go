@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dop251/goja"
+	"runtime"
+	"time"
+)
+
+// ScriptLimits are the limits of the executions of a script
+// PoolSize is the maximum number of concurrent executions. Defaults to the number of CPUs
+// Timeout is the maximum duration of an execution, as a duration string. Defaults to 1s
+// MaxStackDepth is the maximum depth of the call stack of an execution. Defaults to 1000
+type ScriptLimits struct {
+	PoolSize      int
+	Timeout       string
+	MaxStackDepth int
+}
+
+// ScriptPool is a bounded pool of JavaScript runtimes, running a script compiled once
+// program is the compiled script
+// runtimes holds the idle runtimes. A nil runtime is a free slot, which gets a new runtime when acquired
+// timeout is the maximum duration of an execution
+// maxStackDepth is the maximum depth of the call stack of an execution
+// log is the logger of the component owning the pool, publishing the execution time of the script
+type ScriptPool struct {
+	program       *goja.Program
+	runtimes      chan *goja.Runtime
+	timeout       time.Duration
+	maxStackDepth int
+	log           *STLogHelper
+}
+
+// NewScriptPool compiles the script and creates a pool enforcing the given limits
+func NewScriptPool(name string, script string, limits ScriptLimits, log *STLogHelper) (*ScriptPool, error) {
+	// the script runs in a block, so that the let and const declarations don't clash when a runtime is reused.
+	// The opening brace is on the first line, to keep the line numbers of the errors
+	program, err := goja.Compile(name, "{"+script+"\n}", false)
+	if err != nil {
+		return nil, err
+	}
+	pool := ScriptPool{program: program, timeout: time.Second, maxStackDepth: limits.MaxStackDepth, log: log}
+	if limits.Timeout != "" {
+		if pool.timeout, err = time.ParseDuration(limits.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	if pool.maxStackDepth <= 0 {
+		pool.maxStackDepth = 1000
+	}
+	size := limits.PoolSize
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	pool.runtimes = make(chan *goja.Runtime, size)
+	for i := 0; i < size; i++ {
+		pool.runtimes <- nil
+	}
+	log.PrometheusRegisterSummary("script_execution")
+	return &pool, nil
+}
+
+// Run runs the script with the given globals, and returns the exported result. If all the runtimes are busy, it waits
+// for one to become available. If the context is done or the timeout expires while the script is running, the script
+// is interrupted. A panic raised by a Go function called by the script is returned as an error
+func (p *ScriptPool) Run(ctx context.Context, globals map[string]any) (result any, err error) {
+	var vm *goja.Runtime
+	select {
+	case vm = <-p.runtimes:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if vm == nil {
+		vm = goja.New()
+		vm.SetMaxCallStackSize(p.maxStackDepth)
+		vm.SetFieldNameMapper(scriptFieldMapper{})
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	// the runtime goes back to the pool whatever happens, or the slot would be lost for good
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result, err = nil, fmt.Errorf("script panicked: %v", recovered)
+		}
+		// a runtime that failed may be in any state, so its slot is freed rather than risking to reuse it
+		if err != nil {
+			vm = nil
+		} else {
+			resetRuntime(vm)
+		}
+		p.runtimes <- vm
+	}()
+	return p.run(ctx, vm, globals)
+}
+
+// run runs the program in the runtime and publishes the execution time, in microseconds
+func (p *ScriptPool) run(ctx context.Context, vm *goja.Runtime, globals map[string]any) (any, error) {
+	for key, value := range globals {
+		if err := vm.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	// if a scripts directory is configured, the script can require its modules
+	if scriptModules != nil {
+		require, err := scriptModules.Require(vm)
+		if err != nil {
+			return nil, err
+		}
+		if err = vm.Set("require", require); err != nil {
+			return nil, err
+		}
+	}
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			vm.Interrupt("timeout")
+		case <-done:
+		}
+	}()
+	start := time.Now()
+	val, err := vm.RunProgram(p.program)
+	p.log.PrometheusSummaryObserve("script_execution", time.Since(start).Microseconds())
+	// the context may be done right after the script ended, so the interrupt is cleared once the watcher is gone
+	close(done)
+	<-stopped
+	vm.ClearInterrupt()
+	if err != nil {
+		return nil, err
+	}
+	return val.Export(), nil
+}
+
+// resetRuntime removes the globals set by a run, so that nothing leaks to the next one. Globals declared with var
+// can't be removed, so they're set to undefined
+func resetRuntime(vm *goja.Runtime) {
+	global := vm.GlobalObject()
+	for _, key := range global.Keys() {
+		if err := global.Delete(key); err != nil {
+			_ = global.Set(key, goja.Undefined())
+		}
+	}
+}
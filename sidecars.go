@@ -92,14 +92,25 @@ func NewRequestSidecars(sidecars []SidecarConfig) *RequestSidecars {
 				res.Push(sidecar)
 			}
 
+		case "scriptable":
+			sidecar, err := NewScriptableSidecarFromParams(s.Block, s.Queue, s.DropOnOverflow, s.ActivateOnTags, s.Logging, s.Params)
+			if err != nil {
+				log.Error("Could not initialize scriptable sidecar. Bypassing. ", err, nil)
+			} else {
+				sidecar.Consume(s.Workers)
+				res.Push(sidecar)
+			}
+
 		}
 	}
 	return &res
 }
 
 // ResponseSidecars is a collection of response sidecars
+// eventSidecars are the sidecars observing the events of Server-Sent Events responses
 type ResponseSidecars struct {
-	sidecars []ISidecar
+	sidecars      []ISidecar
+	eventSidecars []IEventSidecar
 }
 
 func (s *ResponseSidecars) ShouldExpandRequest() bool {
@@ -145,6 +156,30 @@ func (s *ResponseSidecars) Run(wrapper *APIWrapper) {
 	}
 }
 
+// PushEventSidecar adds an event sidecar to the list of event sidecars
+func (s *ResponseSidecars) PushEventSidecar(sidecar IEventSidecar) {
+	s.eventSidecars = append(s.eventSidecars, sidecar)
+}
+
+// ObservesEvents returns true if at least one sidecar observes the events of Server-Sent Events responses
+func (s *ResponseSidecars) ObservesEvents() bool {
+	return len(s.eventSidecars) > 0
+}
+
+// RunEvent runs all the event sidecars for the given event
+func (s *ResponseSidecars) RunEvent(event *SSEEvent) {
+	for _, sidecar := range s.eventSidecars {
+		if sidecar.IsActive(event.Wrapper) {
+			// events are sent while the response streams, so a non-blocking sidecar must not hold the stream back
+			if sidecar.ShouldBlock() {
+				runEventFunc(sidecar, event)
+			} else {
+				go runEventFunc(sidecar, event)
+			}
+		}
+	}
+}
+
 // runFunc will attempt to send a message to the given sidecar
 func (s *ResponseSidecars) runFunc(sidecar ISidecar, wrapper *APIWrapper) {
 	// Send the message. If the queue is full, drop it
@@ -196,6 +231,33 @@ func NewResponseSidecars(sidecars *[]SidecarConfig) *ResponseSidecars {
 				sidecar.Consume(s.Workers)
 				res.Push(sidecar)
 			}
+
+		case "mirror":
+			sidecar, err := NewMirrorSidecarFromParams(s.Block, s.Queue, s.DropOnOverflow, s.ActivateOnTags, s.Logging, s.Params)
+			if err != nil {
+				log.Error("Could not initialize mirror sidecar. Bypassing. ", err, nil)
+			} else {
+				sidecar.Consume(s.Workers)
+				res.Push(sidecar)
+			}
+
+		case "scriptable":
+			sidecar, err := NewScriptableSidecarFromParams(s.Block, s.Queue, s.DropOnOverflow, s.ActivateOnTags, s.Logging, s.Params)
+			if err != nil {
+				log.Error("Could not initialize scriptable sidecar. Bypassing. ", err, nil)
+			} else {
+				sidecar.Consume(s.Workers)
+				res.Push(sidecar)
+			}
+
+		case "sse-log":
+			sidecar, err := NewSSELogSidecarFromParams(s.Block, s.Queue, s.DropOnOverflow, s.ActivateOnTags, s.Logging, s.Params)
+			if err != nil {
+				log.Error("Could not initialize sse-log sidecar. Bypassing. ", err, nil)
+			} else {
+				sidecar.Consume(s.Workers)
+				res.PushEventSidecar(sidecar)
+			}
 		}
 	}
 	return &res
@@ -68,6 +68,9 @@ func CaptureResponse(wrapper *APIWrapper) *CaptureMessage {
 		Definition: AnyMap{"origin": wrapper.Rule.Origin, "pattern": wrapper.Rule.Pattern},
 		Meta:       make(AnyMap),
 	}
+	if wrapper.Variant != "" {
+		captureMessage.Definition["variant"] = wrapper.Variant
+	}
 	return &captureMessage
 }
 
@@ -106,9 +109,8 @@ func (s *CaptureSidecar) GetChannel() chan *APIWrapper {
 	return s.channel
 }
 
-// Consume starts the consumption workers
-func (s *CaptureSidecar) Consume(quantity int) {
-	var captureFunc func([]byte, *APIWrapper)
+// captureFunc returns the capture function for the destination
+func (s *CaptureSidecar) captureFunc() func([]byte, *APIWrapper) {
 	// If it's a web URL, then we'll use the HTTP capture function
 	if IsHTTP(s.Uri) {
 		to, err := time.ParseDuration(s.Timeout)
@@ -117,10 +119,14 @@ func (s *CaptureSidecar) Consume(quantity int) {
 			to, _ = time.ParseDuration("5s")
 		}
 		s.httpClient = &http.Client{Timeout: to}
-		captureFunc = s.CaptureHttp
-	} else {
-		captureFunc = s.CaptureLogger
+		return s.CaptureHttp
 	}
+	return s.CaptureLogger
+}
+
+// Consume starts the consumption workers
+func (s *CaptureSidecar) Consume(quantity int) {
+	captureFunc := s.captureFunc()
 
 	// For each worker...
 	for i := 0; i < quantity; i++ {
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// MirrorSidecar replays the API conversations against one or more shadow origins. The shadow responses are discarded
+// but the differences in status and latency, compared to the primary origin, are logged and collected as metrics
+// channel is the go inbound channel
+// Origins is the list of shadow origins
+// Sampling is the percentage (0-100) of the conversations that will be mirrored
+// Timeout is the HTTP client timeout
+// httpClient is the HTTP client used to reach the shadow origins
+// _origins is the parsed version of Origins
+type MirrorSidecar struct {
+	channel        chan *APIWrapper
+	log            *STLogHelper
+	block          bool
+	dropOnOverflow bool
+	Origins        []string
+	Sampling       float64
+	Timeout        string
+	ActivateOnTags []string
+	httpClient     *http.Client
+	_origins       []*url.URL
+}
+
+func (s *MirrorSidecar) GetChannel() chan *APIWrapper {
+	return s.channel
+}
+
+func (s *MirrorSidecar) Consume(quantity int) {
+	for i := 0; i < quantity; i++ {
+		go func() {
+			for msg := range s.GetChannel() {
+				// if the request body could not be expanded, we cannot replay the request faithfully
+				if msg.HasTag([]string{"request_not_expanded"}) {
+					s.log.Log("request body not expanded, skipping mirror", msg, s.log.Debug)
+					continue
+				}
+				for _, origin := range s._origins {
+					s.mirror(origin, msg)
+				}
+			}
+		}()
+	}
+}
+
+// mirror will replay the request against the provided shadow origin, and compare the outcome with the primary
+func (s *MirrorSidecar) mirror(origin *url.URL, wrapper *APIWrapper) {
+	shadowURL := replaceOrigin(wrapper.Request.URL, wrapper.Rule.Origin, origin)
+	request, err := http.NewRequestWithContext(context.Background(), wrapper.Request.Method, shadowURL.String(),
+		bytes.NewReader(wrapper.Request.ExpandedBody))
+	if err != nil {
+		s.log.LogErr("could not create the mirror request", err, wrapper, s.log.Error)
+		return
+	}
+	request.Header = wrapper.Request.Header.Clone()
+	// the body we're sending is the expanded one, so the original encoding headers may not apply anymore
+	request.Header.Del("content-length")
+	request.Header.Del("transfer-encoding")
+	s.log.PrometheusCounterInc("mirror_requests")
+	start := time.Now()
+	response, err := s.httpClient.Do(request)
+	shadowLatency := time.Since(start).Milliseconds()
+	if err != nil {
+		s.log.PrometheusCounterInc("mirror_errors")
+		s.log.LogWithErrorMeta("error while reaching the shadow origin", err, wrapper, AnyMap{"shadow": shadowURL.String()}, s.log.Warn)
+		return
+	}
+	// the shadow response is discarded
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+
+	primaryStatus := 0
+	if wrapper.Response != nil {
+		primaryStatus = wrapper.Response.StatusCode
+	}
+	latencyDiff := shadowLatency - wrapper.Metrics.Upstream()
+	if response.StatusCode != primaryStatus {
+		s.log.PrometheusCounterInc("mirror_status_mismatch")
+	}
+	s.log.PrometheusSummaryObserve("mirror_latency_diff", latencyDiff)
+	s.log.LogWithMeta("mirror", wrapper, AnyMap{"shadow": shadowURL.String(), "primary_status": primaryStatus,
+		"shadow_status": response.StatusCode, "primary_latency": wrapper.Metrics.Upstream(),
+		"shadow_latency": shadowLatency, "latency_diff": latencyDiff}, s.log.Info)
+}
+
+func (s *MirrorSidecar) ShouldBlock() bool {
+	return s.block
+}
+
+func (s *MirrorSidecar) ShouldDropOnOverflow() bool {
+	return s.dropOnOverflow
+}
+
+func (s *MirrorSidecar) ShouldExpandRequest() bool {
+	return true
+}
+
+func (s *MirrorSidecar) ShouldExpandResponse() bool {
+	return false
+}
+
+// IsActive will return true if the tags match, and the conversation falls within the sampling percentage
+func (s *MirrorSidecar) IsActive(wrapper *APIWrapper) bool {
+	return wrapper.HasTag(s.ActivateOnTags) && rand.Float64()*100 < s.Sampling
+}
+
+// NewMirrorSidecarFromParams is the constructor for MirrorSidecar
+func NewMirrorSidecarFromParams(block bool, queue int, dropOnOverflow bool, activateOnTags []string, logCfg *STLogConfig, params AnyMap) (*MirrorSidecar, error) {
+	sidecar := MirrorSidecar{channel: make(chan *APIWrapper, queue), block: block, dropOnOverflow: dropOnOverflow,
+		ActivateOnTags: activateOnTags, Sampling: 100, Timeout: "5s"}
+	err := template.DecodeAndTempl(context.Background(), params, &sidecar, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	for _, origin := range sidecar.Origins {
+		parsedOrigin, err := url.Parse(origin)
+		if err != nil {
+			return nil, err
+		}
+		sidecar._origins = append(sidecar._origins, parsedOrigin)
+	}
+	to, err := time.ParseDuration(sidecar.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	sidecar.httpClient = &http.Client{Timeout: to}
+	sidecar.log = NewSTLogHelper(logCfg)
+	sidecar.log.PrometheusRegisterCounter("mirror_requests")
+	sidecar.log.PrometheusRegisterCounter("mirror_errors")
+	sidecar.log.PrometheusRegisterCounter("mirror_status_mismatch")
+	sidecar.log.PrometheusRegisterSummary("mirror_latency_diff")
+	return &sidecar, nil
+}
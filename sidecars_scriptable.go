@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// scriptHTTPMaxBody is the maximum size of the bodies of the responses to the outbound HTTP calls of the scripts
+const scriptHTTPMaxBody = 10 * 1024 * 1024
+
+// scriptHTTPMaxRedirects is the maximum number of redirects followed by the outbound HTTP calls of the scripts
+const scriptHTTPMaxRedirects = 5
+
+// ScriptableSidecar is a sidecar that runs a JavaScript script for each message
+// Script is the script
+// Path is the path to a file containing the script, as an alternative to Script
+// ScriptLimits are the limits of the executions of the script. The timeout also applies to the outbound HTTP calls
+// Dir is the directory the script can write files to. If empty, the script can't write files
+// _pool is the pool of runtimes running the compiled script
+// _dir is the absolute version of Dir
+type ScriptableSidecar struct {
+	channel        chan *APIWrapper
+	log            *STLogHelper
+	block          bool
+	dropOnOverflow bool
+	httpClient     *http.Client
+	Script         string
+	Path           string
+	ScriptLimits   `mapstructure:",squash"`
+	Dir            string
+	ExpandRequest  bool
+	ExpandResponse bool
+	ActivateOnTags []string
+	_pool          *ScriptPool
+	_dir           string
+}
+
+func (s *ScriptableSidecar) GetChannel() chan *APIWrapper {
+	return s.channel
+}
+
+func (s *ScriptableSidecar) Consume(quantity int) {
+	for i := 0; i < quantity; i++ {
+		go func() {
+			for msg := range s.GetChannel() {
+				if err := s.Run(msg); err != nil {
+					s.log.LogErr("error while running sidecar script", err, msg, s.log.Error)
+					s.log.PrometheusCounterInc("script_errors")
+				}
+			}
+		}()
+	}
+}
+
+// Run runs the script for the given message. The script can read the transaction, but not modify it
+func (s *ScriptableSidecar) Run(wrapper *APIWrapper) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s._pool.timeout)
+	defer cancel()
+	api := scriptAPI{wrapper: wrapper, log: s.log}
+	globals := map[string]any{
+		"request":     api.requestReader(),
+		"response":    nil,
+		"transaction": api.transactionReader(),
+		"log":         api.logObject(),
+		"metrics":     api.metricsObject(),
+		"http":        s.httpObject(ctx),
+		"files":       s.filesObject(),
+	}
+	if wrapper.Response != nil {
+		globals["response"] = api.responseReader()
+	}
+	_, err := s._pool.Run(ctx, globals)
+	return err
+}
+
+// httpObject returns the object making outbound HTTP calls, bound to the given context
+func (s *ScriptableSidecar) httpObject(ctx context.Context) map[string]any {
+	return map[string]any{
+		"request": func(options map[string]any) (map[string]any, error) {
+			return s.httpRequest(ctx, options)
+		},
+	}
+}
+
+// httpRequest makes an outbound HTTP call. The options are the method (defaults to GET), the url, the headers and the
+// body. A body that is not a string is encoded in JSON
+func (s *ScriptableSidecar) httpRequest(ctx context.Context, options map[string]any) (map[string]any, error) {
+	method, _ := options["method"].(string)
+	if method == "" {
+		method = http.MethodGet
+	}
+	url, _ := options["url"].(string)
+	if url == "" {
+		return nil, errors.New("the url of the HTTP request is required")
+	}
+	var body io.Reader
+	contentType := ""
+	switch data := options["body"].(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(data)
+	default:
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(encoded)
+		contentType = "application/json"
+	}
+	request, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("content-type", contentType)
+	}
+	if headers, ok := options["headers"].(map[string]any); ok {
+		for k, v := range headers {
+			if value, ok := v.(string); ok {
+				request.Header.Set(k, value)
+			}
+		}
+	}
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	data, err := io.ReadAll(io.LimitReader(response.Body, scriptHTTPMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"status": response.StatusCode, "headers": joinHeaders(response.Header), "body": string(data)}, nil
+}
+
+// filesObject returns the object writing files in the directory of the sidecar
+func (s *ScriptableSidecar) filesObject() map[string]any {
+	return map[string]any{
+		"write": func(name string, data string) error {
+			return s.writeFile(name, data, os.O_TRUNC)
+		},
+		"append": func(name string, data string) error {
+			return s.writeFile(name, data, os.O_APPEND)
+		},
+	}
+}
+
+// writeFile writes data to a file in the directory of the sidecar. Files outside the directory can't be written
+func (s *ScriptableSidecar) writeFile(name string, data string, flag int) error {
+	if s._dir == "" {
+		return errors.New("the sidecar has no directory to write files to")
+	}
+	path := filepath.Join(s._dir, name)
+	if !strings.HasPrefix(path, s._dir+string(filepath.Separator)) {
+		return errors.New("file outside the sidecar directory: " + name)
+	}
+	// symbolic links are not allowed to escape the directory either. A link to a missing file is not allowed, as
+	// writing to it would create its target
+	target := filepath.Dir(path)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		target = path
+	}
+	resolvedDir, err := filepath.EvalSymlinks(s._dir)
+	if err != nil {
+		return err
+	}
+	resolvedTarget, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+	if !isWithin(resolvedDir, resolvedTarget) {
+		return errors.New("file outside the sidecar directory: " + name)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *ScriptableSidecar) ShouldBlock() bool {
+	return s.block
+}
+
+func (s *ScriptableSidecar) ShouldDropOnOverflow() bool {
+	return s.dropOnOverflow
+}
+
+func (s *ScriptableSidecar) ShouldExpandRequest() bool {
+	return s.ExpandRequest
+}
+
+func (s *ScriptableSidecar) ShouldExpandResponse() bool {
+	return s.ExpandResponse
+}
+
+func (s *ScriptableSidecar) IsActive(wrapper *APIWrapper) bool {
+	return wrapper.HasTag(s.ActivateOnTags)
+}
+
+// scriptHTTPRedirectPolicy stops the HTTP calls of the scripts after scriptHTTPMaxRedirects redirects
+func scriptHTTPRedirectPolicy(_ *http.Request, via []*http.Request) error {
+	if len(via) >= scriptHTTPMaxRedirects {
+		return errors.New("stopped after " + strconv.Itoa(scriptHTTPMaxRedirects) + " redirects")
+	}
+	return nil
+}
+
+// NewScriptableSidecarFromParams creates a ScriptableSidecar from params
+func NewScriptableSidecarFromParams(block bool, queue int, dropOnOverflow bool, activateOnTags []string, logCfg *STLogConfig, params AnyMap) (*ScriptableSidecar, error) {
+	sidecar := ScriptableSidecar{channel: make(chan *APIWrapper, queue), block: block, dropOnOverflow: dropOnOverflow,
+		ActivateOnTags: activateOnTags}
+	err := template.DecodeAndTempl(context.Background(), params, &sidecar, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	sidecar.log = NewSTLogHelper(logCfg)
+	if sidecar.Dir != "" {
+		if sidecar._dir, err = filepath.Abs(sidecar.Dir); err != nil {
+			return nil, err
+		}
+	}
+	script, err := loadScript(sidecar.Script, sidecar.Path)
+	if err != nil {
+		return nil, err
+	}
+	if sidecar._pool, err = NewScriptPool(sidecar.Path, script, sidecar.ScriptLimits, sidecar.log); err != nil {
+		return nil, err
+	}
+	// the HTTP calls are bounded by the script timeout and follow a limited number of redirects
+	sidecar.httpClient = &http.Client{Timeout: sidecar._pool.timeout, CheckRedirect: scriptHTTPRedirectPolicy}
+	sidecar.log.PrometheusRegisterCounter("script_errors")
+	return &sidecar, nil
+}
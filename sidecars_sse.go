@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"strconv"
+	"time"
+)
+
+// SSEEvent is an event of a Server-Sent Events response
+// Wrapper is a clone of the wrapper of the transaction streaming the event
+// ID is the event ID, if any
+// Event is the event type, if any
+// Data is the event data. Multiple data lines are joined by a newline
+// Retry is the reconnection time, in milliseconds, if any
+// Time is when the event was received
+type SSEEvent struct {
+	Wrapper *APIWrapper
+	ID      string
+	Event   string
+	Data    string
+	Retry   int
+	Time    time.Time
+}
+
+// IEventSidecar is the interface for the sidecars observing the events of Server-Sent Events responses
+// Consume will start consuming the events. It receives an int as parameter that determines how many instances
+// of the `consume` go-routines should be launched
+// GetChannel will return the inbound channel for the sidecar
+// ShouldBlock will return true if the sidecar should block or should be completely asynchronous
+// ShouldDropOnOverflow will return true if the inbound events should be dropped if the channel is full
+// IsActive will return true if the sidecar is interested in the events of this transaction
+type IEventSidecar interface {
+	Consume(consumers int)
+	GetChannel() chan *SSEEvent
+	ShouldBlock() bool
+	ShouldDropOnOverflow() bool
+	IsActive(wrapper *APIWrapper) bool
+}
+
+// runEventFunc will attempt to send an event to the given sidecar
+func runEventFunc(sidecar IEventSidecar, event *SSEEvent) {
+	// Send the event. If the queue is full, drop it
+	if sidecar.ShouldDropOnOverflow() {
+		select {
+		case sidecar.GetChannel() <- event:
+		default:
+		}
+	} else {
+		// Send the event. If the queue is full, block
+		sidecar.GetChannel() <- event
+	}
+}
+
+// isEventStream returns true if the content type is the one of Server-Sent Events
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream"
+}
+
+// ObserveEvents makes the event sidecars observe the events of a Server-Sent Events response, while the body streams
+// to the client. Compressed streams are not observed
+func (w *APIWrapper) ObserveEvents() {
+	if !w.Rule.Response._sidecars.ObservesEvents() || !isEventStream(w.Response.Header.Get("content-type")) ||
+		w.Response.Header.Get("content-encoding") != "" || w.Response.Body == nil {
+		return
+	}
+	source := w.Clone()
+	w.Response.Body = NewSSEReader(w.Response.Body, w.Rule.GetMaxExpandSize(), func(event *SSEEvent) {
+		event.Wrapper = source
+		w.Rule.Response._sidecars.RunEvent(event)
+	})
+}
+
+// SSEReader is a reader parsing the Server-Sent Events passing through it, without buffering the stream
+// line is the line being read
+// maxLineSize is the maximum size of a line. Longer lines are truncated. Zero means no limit
+// event is the event being read
+// pending is true if the event being read has at least one field
+// emit is called for each event
+type SSEReader struct {
+	io.ReadCloser
+	line        []byte
+	maxLineSize int64
+	event       SSEEvent
+	pending     bool
+	emit        func(event *SSEEvent)
+}
+
+// NewSSEReader is the constructor for SSEReader
+func NewSSEReader(body io.ReadCloser, maxLineSize int64, emit func(event *SSEEvent)) *SSEReader {
+	return &SSEReader{ReadCloser: body, maxLineSize: maxLineSize, emit: emit}
+}
+
+// Read reads from the stream and parses the events in what has been read
+func (r *SSEReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	data := p[:n]
+	for len(data) > 0 {
+		index := bytes.IndexByte(data, '\n')
+		if index < 0 {
+			r.appendLine(data)
+			break
+		}
+		r.appendLine(data[:index])
+		r.parseLine(bytes.TrimSuffix(r.line, []byte("\r")))
+		r.line = r.line[:0]
+		data = data[index+1:]
+	}
+	return n, err
+}
+
+// appendLine appends data to the line being read, up to the maximum line size
+func (r *SSEReader) appendLine(data []byte) {
+	if r.maxLineSize > 0 && int64(len(r.line)+len(data)) > r.maxLineSize {
+		data = data[:r.maxLineSize-int64(len(r.line))]
+	}
+	r.line = append(r.line, data...)
+}
+
+// parseLine parses a line of the stream. An empty line dispatches the event being read
+func (r *SSEReader) parseLine(line []byte) {
+	if len(line) == 0 {
+		if r.pending {
+			event := r.event
+			event.Time = time.Now()
+			r.emit(&event)
+		}
+		r.event = SSEEvent{}
+		r.pending = false
+		return
+	}
+	// lines starting with a colon are comments
+	if line[0] == ':' {
+		return
+	}
+	field, value, _ := bytes.Cut(line, []byte(":"))
+	value = bytes.TrimPrefix(value, []byte(" "))
+	switch string(field) {
+	case "data":
+		if r.pending && r.event.Data != "" {
+			r.event.Data += "\n"
+		}
+		r.event.Data += string(value)
+	case "event":
+		r.event.Event = string(value)
+	case "id":
+		r.event.ID = string(value)
+	case "retry":
+		r.event.Retry, _ = strconv.Atoi(string(value))
+	default:
+		return
+	}
+	r.pending = true
+}
+
+// SSELogSidecar logs the events of Server-Sent Events responses
+// IncludeData, if true, adds the event data to the log entries
+type SSELogSidecar struct {
+	channel        chan *SSEEvent
+	log            *STLogHelper
+	block          bool
+	dropOnOverflow bool
+	IncludeData    bool
+	ActivateOnTags []string
+}
+
+func (s *SSELogSidecar) GetChannel() chan *SSEEvent {
+	return s.channel
+}
+
+func (s *SSELogSidecar) Consume(quantity int) {
+	for i := 0; i < quantity; i++ {
+		go func() {
+			for msg := range s.GetChannel() {
+				meta := AnyMap{"event": msg.Event, "event_id": msg.ID, "size": len(msg.Data)}
+				if s.IncludeData {
+					meta["data"] = msg.Data
+				}
+				s.log.LogWithMeta("server-sent event", msg.Wrapper, meta, s.log.Info)
+				s.log.PrometheusCounterInc("sse_events")
+			}
+		}()
+	}
+}
+
+func (s *SSELogSidecar) ShouldBlock() bool {
+	return s.block
+}
+
+func (s *SSELogSidecar) ShouldDropOnOverflow() bool {
+	return s.dropOnOverflow
+}
+
+func (s *SSELogSidecar) IsActive(wrapper *APIWrapper) bool {
+	return wrapper.HasTag(s.ActivateOnTags)
+}
+
+// NewSSELogSidecarFromParams creates an SSELogSidecar from params
+func NewSSELogSidecarFromParams(block bool, queue int, dropOnOverflow bool, activateOnTags []string, logCfg *STLogConfig, params AnyMap) (*SSELogSidecar, error) {
+	sidecar := SSELogSidecar{channel: make(chan *SSEEvent, queue), block: block, dropOnOverflow: dropOnOverflow, ActivateOnTags: activateOnTags}
+	err := template.DecodeAndTempl(context.Background(), params, &sidecar, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	sidecar.log = NewSTLogHelper(logCfg)
+	sidecar.log.PrometheusRegisterCounter("sse_events")
+	return &sidecar, nil
+}
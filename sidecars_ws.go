@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// IWSSidecar is the interface for all websocket message sidecars
+// Consume will start consuming the messages. It receives an int as parameter that determines how many instances
+// of the `consume` go-routines should be launched
+// GetChannel will return the inbound channel for the sidecar
+// ShouldBlock will return true if the sidecar should block or should be completely asynchronous
+// ShouldDropOnOverflow will return true if the inbound messages should be dropped if the channel is full
+// IsActive will return true if the sidecar is interested in this message
+type IWSSidecar interface {
+	Consume(consumers int)
+	GetChannel() chan *WSMessage
+	ShouldBlock() bool
+	ShouldDropOnOverflow() bool
+	IsActive(message *WSMessage) bool
+}
+
+// WSSidecars is a collection of websocket message sidecars
+type WSSidecars struct {
+	sidecars []IWSSidecar
+}
+
+// Push will push a new sidecar to the list of sidecars
+func (s *WSSidecars) Push(sidecar IWSSidecar) {
+	s.sidecars = append(s.sidecars, sidecar)
+}
+
+// Run will run all the sidecars against the provided message
+func (s *WSSidecars) Run(message *WSMessage) {
+	for _, sidecar := range s.sidecars {
+		if sidecar.IsActive(message) {
+			if sidecar.ShouldBlock() {
+				s.runFunc(sidecar, message)
+			} else {
+				go s.runFunc(sidecar, message)
+			}
+		}
+	}
+}
+
+// runFunc will attempt to send a message to the given sidecar
+func (s *WSSidecars) runFunc(sidecar IWSSidecar, message *WSMessage) {
+	// Send the message. If the queue is full, drop it
+	if sidecar.ShouldDropOnOverflow() {
+		select {
+		case sidecar.GetChannel() <- message:
+		default:
+		}
+	} else {
+		// Send the message. If the queue is full, block
+		sidecar.GetChannel() <- message
+	}
+}
+
+// NewWSSidecars is the constructor of WSSidecars
+func NewWSSidecars(sidecars []SidecarConfig) *WSSidecars {
+	res := WSSidecars{}
+	for _, s := range sidecars {
+		if s.Workers == 0 {
+			s.Workers = 1
+		}
+		if s.Queue == 0 {
+			s.Queue = 1
+		}
+		var sidecar IWSSidecar
+		var err error
+		switch s.Id {
+		case "access-log":
+			sidecar, err = NewWSAccessLogSidecarFromParams(s.Block, s.Queue, s.DropOnOverflow, s.ActivateOnTags, s.Logging, s.Params)
+		case "capture":
+			sidecar, err = NewWSCaptureSidecarFromParams(s.Block, s.Queue, s.DropOnOverflow, s.ActivateOnTags, s.Logging, s.Params)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Error("Could not initialise websocket sidecar "+s.Id, err, nil)
+			continue
+		}
+		sidecar.Consume(s.Workers)
+		res.Push(sidecar)
+	}
+	return &res
+}
+
+// WSAccessLogSidecar logs the messages travelling in websocket connections
+type WSAccessLogSidecar struct {
+	channel        chan *WSMessage
+	log            *STLogHelper
+	block          bool
+	dropOnOverflow bool
+	ActivateOnTags []string
+}
+
+func (s *WSAccessLogSidecar) GetChannel() chan *WSMessage {
+	return s.channel
+}
+
+func (s *WSAccessLogSidecar) Consume(quantity int) {
+	for i := 0; i < quantity; i++ {
+		go func() {
+			for msg := range s.GetChannel() {
+				s.log.LogWithMeta("websocket message", msg.Connection.Wrapper, wsMessageMeta(msg), s.log.Info)
+				s.log.PrometheusCounterInc("ws_messages")
+			}
+		}()
+	}
+}
+
+func (s *WSAccessLogSidecar) ShouldBlock() bool {
+	return s.block
+}
+
+func (s *WSAccessLogSidecar) ShouldDropOnOverflow() bool {
+	return s.dropOnOverflow
+}
+
+func (s *WSAccessLogSidecar) IsActive(message *WSMessage) bool {
+	return message.Connection.Wrapper.HasTag(s.ActivateOnTags)
+}
+
+// NewWSAccessLogSidecarFromParams constructor for WSAccessLogSidecar from params
+func NewWSAccessLogSidecarFromParams(block bool, queue int, dropOnOverflow bool, activateOnTags []string, logCfg *STLogConfig, _ AnyMap) (*WSAccessLogSidecar, error) {
+	sidecar := WSAccessLogSidecar{channel: make(chan *WSMessage, queue), block: block, dropOnOverflow: dropOnOverflow, ActivateOnTags: activateOnTags}
+	sidecar.log = NewSTLogHelper(logCfg)
+	sidecar.log.PrometheusRegisterCounter("ws_messages")
+	return &sidecar, nil
+}
+
+// WSCaptureMessage represents the serialization of a websocket message
+// Connection is the connection the message belongs to
+// Direction is either "inbound" or "outbound"
+// Type is either "text" or "binary"
+// Data is the content of the message. Binary messages are base64 encoded
+// Size is the size of the message
+// Time is when the message was received
+// Definition represent meta information of what rules where applied
+type WSCaptureMessage struct {
+	Connection WSConnectionCapture `json:"connection"`
+	Direction  string              `json:"direction"`
+	Type       string              `json:"type"`
+	Data       string              `json:"data"`
+	Size       int                 `json:"size"`
+	Time       time.Time           `json:"time"`
+	Definition AnyMap              `json:"definition"`
+}
+
+// WSConnectionCapture represents the serialization of a websocket connection
+// ID is the ID of the transaction that opened the connection
+// IP is the client IP address
+// Url is the URL of the origin
+// Tags are the tags of the transaction that opened the connection
+// Start is when the connection was established
+type WSConnectionCapture struct {
+	ID    string    `json:"id"`
+	IP    string    `json:"ip"`
+	Url   string    `json:"url"`
+	Tags  []string  `json:"tags"`
+	Start time.Time `json:"start"`
+}
+
+// CaptureWSMessage populates a WSCaptureMessage out of a message
+func CaptureWSMessage(message *WSMessage) *WSCaptureMessage {
+	wrapper := message.Connection.Wrapper
+	data := string(message.Data)
+	if message.TypeName() == "binary" {
+		data = base64.StdEncoding.EncodeToString(message.Data)
+	}
+	return &WSCaptureMessage{
+		Connection: WSConnectionCapture{ID: message.Connection.ID, IP: wrapper.RealIP, Url: wrapper.Request.URL.String(),
+			Tags: wrapper.Tags, Start: message.Connection.Start},
+		Direction:  message.Direction,
+		Type:       message.TypeName(),
+		Data:       data,
+		Size:       len(message.Data),
+		Time:       message.Time,
+		Definition: AnyMap{"origin": wrapper.Rule.Origin, "pattern": wrapper.Rule.Pattern},
+	}
+}
+
+// WSCaptureSidecar is the sidecar for capturing websocket messages. The destination is configured like the one of
+// the CaptureSidecar
+type WSCaptureSidecar struct {
+	*CaptureSidecar
+	channel chan *WSMessage
+}
+
+func (s *WSCaptureSidecar) GetChannel() chan *WSMessage {
+	return s.channel
+}
+
+// Consume starts the consumption workers
+func (s *WSCaptureSidecar) Consume(quantity int) {
+	captureFunc := s.captureFunc()
+	for i := 0; i < quantity; i++ {
+		go func() {
+			for msg := range s.GetChannel() {
+				data, _ := json.Marshal(CaptureWSMessage(msg))
+				captureFunc(data, msg.Connection.Wrapper)
+			}
+		}()
+	}
+}
+
+func (s *WSCaptureSidecar) IsActive(message *WSMessage) bool {
+	return message.Connection.Wrapper.HasTag(s.ActivateOnTags)
+}
+
+// NewWSCaptureSidecarFromParams is the constructor
+func NewWSCaptureSidecarFromParams(block bool, queue int, dropOnOverflow bool, activateOnTags []string, logCfg *STLogConfig, params AnyMap) (*WSCaptureSidecar, error) {
+	sidecar, err := NewCaptureSidecarFromParams(block, 0, dropOnOverflow, activateOnTags, logCfg, params)
+	if err != nil {
+		return nil, err
+	}
+	return &WSCaptureSidecar{CaptureSidecar: sidecar, channel: make(chan *WSMessage, queue)}, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/theirish81/gowalker"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templateTimeLayouts are the named layouts of the Now function
+var templateTimeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+	"TimeOnly":    "15:04:05",
+}
+
+// templateRegexps caches the compiled regular expressions of the Regex functions, by pattern
+var templateRegexps sync.Map
+
+// addTemplateFunctions registers the general purpose functions of the templates
+func addTemplateFunctions(functions *gowalker.Functions) {
+	functions.Add("GetCookie", templateGetCookie)
+	functions.Add("GetClaim", func(ctx context.Context, data any, params ...string) (any, error) {
+		d, ok := data.(APIWrapper)
+		if !ok {
+			return "", errors.New("cannot invoke GetClaim function against this type")
+		}
+		if err := templateParams("GetClaim", params, 1); err != nil {
+			return nil, err
+		}
+		if d.Claims == nil {
+			return nil, nil
+		}
+		return gowalker.Walk(ctx, params[0], map[string]any(*d.Claims), functions)
+	})
+	functions.Add("Base64Encode", func(ctx context.Context, data any, params ...string) (any, error) {
+		return base64.StdEncoding.EncodeToString([]byte(templateString(data))), nil
+	})
+	functions.Add("Base64Decode", func(ctx context.Context, data any, params ...string) (any, error) {
+		decoded, err := base64.StdEncoding.DecodeString(templateString(data))
+		return string(decoded), err
+	})
+	functions.Add("URLEncode", func(ctx context.Context, data any, params ...string) (any, error) {
+		return url.QueryEscape(templateString(data)), nil
+	})
+	functions.Add("SHA256", func(ctx context.Context, data any, params ...string) (any, error) {
+		sum := sha256.Sum256([]byte(templateString(data)))
+		return hex.EncodeToString(sum[:]), nil
+	})
+	functions.Add("HMAC", templateHMAC)
+	functions.Add("Now", templateNow)
+	functions.Add("UUID", func(ctx context.Context, data any, params ...string) (any, error) {
+		return uuid.NewString(), nil
+	})
+	functions.Add("RegexExtract", func(ctx context.Context, data any, params ...string) (any, error) {
+		if err := templateParams("RegexExtract", params, 1); err != nil {
+			return nil, err
+		}
+		rx, err := templateRegexp(params[0])
+		if err != nil {
+			return nil, err
+		}
+		match := rx.FindStringSubmatch(templateString(data))
+		switch len(match) {
+		case 0:
+			return "", nil
+		case 1:
+			return match[0], nil
+		default:
+			return match[1], nil
+		}
+	})
+	functions.Add("RegexReplace", func(ctx context.Context, data any, params ...string) (any, error) {
+		if err := templateParams("RegexReplace", params, 2); err != nil {
+			return nil, err
+		}
+		rx, err := templateRegexp(params[0])
+		if err != nil {
+			return nil, err
+		}
+		return rx.ReplaceAllString(templateString(data), params[1]), nil
+	})
+	functions.Add("JSON", func(ctx context.Context, data any, params ...string) (any, error) {
+		encoded, err := json.Marshal(data)
+		return string(encoded), err
+	})
+	functions.Add("JSONPath", templateJSONPath)
+	functions.Add("Default", func(ctx context.Context, data any, params ...string) (any, error) {
+		if data == nil || data == "" {
+			if len(params) == 0 {
+				return "", nil
+			}
+			return params[0], nil
+		}
+		return data, nil
+	})
+	functions.Add("Coalesce", func(ctx context.Context, data any, params ...string) (any, error) {
+		for _, p := range params {
+			if val, err := gowalker.Walk(ctx, p, data, functions); err == nil && val != nil && val != "" {
+				return val, nil
+			}
+		}
+		return nil, nil
+	})
+	functions.Add("Lower", func(ctx context.Context, data any, params ...string) (any, error) {
+		return strings.ToLower(templateString(data)), nil
+	})
+	functions.Add("Upper", func(ctx context.Context, data any, params ...string) (any, error) {
+		return strings.ToUpper(templateString(data)), nil
+	})
+	functions.Add("Env", func(ctx context.Context, data any, params ...string) (any, error) {
+		if err := templateParams("Env", params, 1); err != nil {
+			return nil, err
+		}
+		return os.Getenv(params[0]), nil
+	})
+}
+
+// templateGetCookie returns the value of a cookie of the request, or of a cookie set by the response
+func templateGetCookie(_ context.Context, data any, params ...string) (any, error) {
+	if err := templateParams("GetCookie", params, 1); err != nil {
+		return nil, err
+	}
+	switch d := data.(type) {
+	case APIRequest:
+		if cookie, err := d.Cookie(params[0]); err == nil {
+			return cookie.Value, nil
+		}
+		return "", nil
+	case APIResponse:
+		for _, cookie := range d.Cookies() {
+			if cookie.Name == params[0] {
+				return cookie.Value, nil
+			}
+		}
+		return "", nil
+	default:
+		return "", errors.New("cannot invoke GetCookie function against this type")
+	}
+}
+
+// templateHMAC returns the HMAC-SHA256 of the selected value, in hex or base64. As the parameters can't contain most
+// special characters, the first parameter is the name of the variable holding the secret
+func templateHMAC(_ context.Context, data any, params ...string) (any, error) {
+	if err := templateParams("HMAC", params, 1); err != nil {
+		return nil, err
+	}
+	secret, ok := config.Variables[params[0]]
+	if !ok {
+		return nil, errors.New("variable not found: " + params[0])
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(templateString(data)))
+	if len(params) > 1 && params[1] == "base64" {
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// templateNow returns the current time, formatted with a named layout, a Go layout, or as a Unix timestamp. The
+// optional second parameter is the name of the time zone. Defaults to RFC3339 and the local time zone
+func templateNow(_ context.Context, _ any, params ...string) (any, error) {
+	now := time.Now()
+	if len(params) > 1 {
+		location, err := time.LoadLocation(params[1])
+		if err != nil {
+			return nil, err
+		}
+		now = now.In(location)
+	}
+	layout := time.RFC3339
+	if len(params) > 0 && params[0] != "" {
+		layout = params[0]
+	}
+	switch layout {
+	case "Unix":
+		return strconv.FormatInt(now.Unix(), 10), nil
+	case "UnixMilli":
+		return strconv.FormatInt(now.UnixMilli(), 10), nil
+	}
+	if named, ok := templateTimeLayouts[layout]; ok {
+		layout = named
+	}
+	return now.Format(layout), nil
+}
+
+// templateJSONPath selects a value from a JSON document, with a path such as $.items.0.name. Requests and responses
+// are selected by their parsed body, or by their expanded body, if not parsed
+func templateJSONPath(_ context.Context, data any, params ...string) (any, error) {
+	if err := templateParams("JSONPath", params, 1); err != nil {
+		return nil, err
+	}
+	var err error
+	switch d := data.(type) {
+	case APIRequest:
+		data, err = parseScriptJSON(d.ParsedBody, d.ExpandedBody)
+	case APIResponse:
+		data, err = parseScriptJSON(d.ParsedBody, d.ExpandedBody)
+	}
+	if err != nil {
+		return nil, err
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(params[0], "$"), ".")
+	if path == "" {
+		return data, nil
+	}
+	for _, segment := range strings.Split(path, ".") {
+		switch d := data.(type) {
+		case map[string]any:
+			data = d[segment]
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(d) {
+				return nil, nil
+			}
+			data = d[index]
+		default:
+			return nil, nil
+		}
+	}
+	return data, nil
+}
+
+// templateRegexp returns the compiled regular expression held by the variable with the given name. As the parameters
+// can't contain most special characters, patterns are declared as variables
+func templateRegexp(name string) (*regexp.Regexp, error) {
+	pattern, ok := config.Variables[name]
+	if !ok {
+		return nil, errors.New("variable not found: " + name)
+	}
+	if rx, ok := templateRegexps.Load(pattern); ok {
+		return rx.(*regexp.Regexp), nil
+	}
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	templateRegexps.Store(pattern, rx)
+	return rx, nil
+}
+
+// templateParams returns an error if the function received less than the required number of parameters
+func templateParams(function string, params []string, required int) error {
+	if len(params) < required {
+		return fmt.Errorf("%s requires %d parameters", function, required)
+	}
+	return nil
+}
+
+// templateString converts the selected value to a string. A missing value is an empty string
+func templateString(data any) string {
+	switch d := data.(type) {
+	case nil:
+		return ""
+	case string:
+		return d
+	case []byte:
+		return string(d)
+	default:
+		return fmt.Sprint(d)
+	}
+}
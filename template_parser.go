@@ -5,7 +5,11 @@ import (
 	"errors"
 	"github.com/mitchellh/mapstructure"
 	"github.com/theirish81/gowalker"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strings"
 )
 
 // RPTemplate handles templates
@@ -26,6 +30,14 @@ func NewRPTemplate() RPTemplate {
 			return "", errors.New("cannot invoke GetHeader function against this type")
 		}
 	})
+	t.functions.Add("GetQuery", func(context context.Context, data any, params ...string) (any, error) {
+		switch d := data.(type) {
+		case APIRequest:
+			return d.URL.Query().Get(params[0]), nil
+		default:
+			return "", errors.New("cannot invoke GetQuery function against this type")
+		}
+	})
 	t.functions.Add("Keys", func(ctx context.Context, data any, params ...string) (any, error) {
 		if reflect.TypeOf(data).Kind() == reflect.Map {
 			keys := reflect.ValueOf(data).MapKeys()
@@ -44,6 +56,7 @@ func NewRPTemplate() RPTemplate {
 		}
 		return nil, errors.New("cannot obtain keys from a data type that is not a map")
 	})
+	addTemplateFunctions(t.functions)
 	return t
 }
 
@@ -65,6 +78,35 @@ func (t *RPTemplate) TemplWithSub(ctx context.Context, data string, subTemplates
 	}
 }
 
+// loadTemplateWithSub will load the main template at the provided path, and all the other files in the same directory
+// as sub-templates, named after the file name, minus the extension
+func loadTemplateWithSub(templatePath string) (string, gowalker.SubTemplates, error) {
+	// reading the master template
+	data, err := os.ReadFile(templatePath)
+	if err != nil {
+		return "", nil, err
+	}
+	// loading the sub-templates, if any
+	templDir := path.Dir(templatePath)
+	subTemplates := gowalker.NewSubTemplates()
+	files, err := os.ReadDir(templDir)
+	if err != nil {
+		return "", nil, err
+	}
+	rootTemplateName := filepath.Base(templatePath)
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") && file.Name() != rootTemplateName {
+			subData, _ := os.ReadFile(path.Join(templDir, file.Name()))
+			subTemplateName := file.Name()
+			if strings.Contains(subTemplateName, ".") {
+				subTemplateName = subTemplateName[0:strings.LastIndex(subTemplateName, ".")]
+			}
+			subTemplates[subTemplateName] = string(subData)
+		}
+	}
+	return string(data), subTemplates, nil
+}
+
 // DecodeAndTempl will decode a map[string]any into a target data structure. Then it will evaluate all the
 // templates found in the decoded structure, against a provided scope (see Templ). Evaluation will not trigger for
 // any field listed in the excludeVal array
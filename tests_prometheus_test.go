@@ -1,10 +1,16 @@
 package main
 
-import "testing"
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
 
 func TestPrometheus(t *testing.T) {
 	p := NewPrometheus()
-	if p.CustomSummaries == nil || p.CustomCounters == nil || p.InternalErrorsCounter == nil {
+	if p.CustomSummaries == nil || p.CustomCounters == nil || p.InternalErrorsCounter == nil ||
+		p.TimeoutsCounter == nil || p.DBStats == nil {
 		t.Error("prometheus init did not work")
 	}
 	c := p.CustomCounter("foo")
@@ -20,3 +26,24 @@ func TestPrometheus(t *testing.T) {
 	}
 
 }
+
+func TestDBStatsCollector(t *testing.T) {
+	collector := NewDBStatsCollector()
+	db, _ := sql.Open("sqlite", ":memory:")
+	defer func() {
+		_ = db.Close()
+	}()
+	db.SetMaxOpenConns(3)
+	collector.Add("localhost", "/users", db)
+	metrics := make(chan prometheus.Metric, 100)
+	collector.Collect(metrics)
+	close(metrics)
+	if len(metrics) != len(collector.descriptions) {
+		t.Error("Unexpected number of database metrics", len(metrics))
+	}
+	metric := dto.Metric{}
+	_ = (<-metrics).Write(&metric)
+	if metric.GetGauge().GetValue() != 3 || len(metric.GetLabel()) != 2 {
+		t.Error("Unexpected maximum open connections metric", metric.String())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScriptModules(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "lib"), 0755)
+	writeModule := func(name string, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the modification time may not change within the resolution of the file system
+		modTime := time.Now().Add(time.Duration(len(content)) * time.Second)
+		_ = os.Chtimes(path, modTime, modTime)
+	}
+	writeModule("lib/auth.js", "const util = require('./util')\nexports.check = function (key) { return util.trim(key) === 'secret' }")
+	writeModule("lib/util.js", "module.exports = {trim: function (s) { return s.trim() }}")
+	writeModule("lib/loop.js", "while (true) {}")
+	var err error
+	if scriptModules, err = NewScriptModules(dir); err != nil {
+		t.Fatal("Could not load the scripts directory", err)
+	}
+	defer func() {
+		scriptModules = nil
+	}()
+
+	run := func(script string, key string) error {
+		transformer, err := NewScriptableTransformer(nil, nil, map[string]any{"script": script, "timeout": "50ms"})
+		if err != nil {
+			t.Fatal("Could not create the scriptable transformer", err)
+		}
+		request, _ := http.NewRequest("GET", "http://example.com", nil)
+		request.Header.Set("x-key", key)
+		wrapper := APIWrapper{Request: NewAPIRequest(request), Context: context.Background()}
+		_, err = transformer.Transform(&wrapper)
+		return err
+	}
+	script := "require('lib/auth').check(request.getHeader('x-key'))"
+	if err := run(script, " secret "); err != nil {
+		t.Error("Modules not loaded", err)
+	}
+	if err := run(script, "foo"); err == nil || err.Error() != "script_rejected" {
+		t.Error("Unexpected module result", err)
+	}
+	writeModule("lib/util.js", "module.exports = {trim: function (s) { return 'secret' }} // changed")
+	if err := run(script, "foo"); err != nil {
+		t.Error("Changed modules should be reloaded", err)
+	}
+	if _, ok := run("require('../outside')\ntrue", "").(*ScriptResponse); !ok {
+		t.Error("Modules outside the scripts directory should not be loaded")
+	}
+	outside := t.TempDir()
+	_ = os.WriteFile(filepath.Join(outside, "outside.js"), []byte("exports.ok = true"), 0644)
+	_ = os.Symlink(filepath.Join(outside, "outside.js"), filepath.Join(dir, "lib", "link.js"))
+	_ = os.Symlink(outside, filepath.Join(dir, "linked"))
+	if _, ok := run("require('lib/link').ok", "").(*ScriptResponse); !ok {
+		t.Error("Modules linking outside the scripts directory should not be loaded")
+	}
+	if _, ok := run("require('linked/outside').ok", "").(*ScriptResponse); !ok {
+		t.Error("Modules in directories linking outside the scripts directory should not be loaded")
+	}
+	if _, ok := run("try { require('lib/loop') } catch (e) {}\ntrue", "").(*ScriptResponse); !ok {
+		t.Error("Modules should be interrupted, whatever the script does")
+	}
+}
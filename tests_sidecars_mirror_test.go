@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMirrorSidecar(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		received <- request.Method + " " + request.URL.Path + " " + string(body)
+		writer.WriteHeader(201)
+	}))
+	defer server.Close()
+	sidecar, err := NewMirrorSidecarFromParams(false, 1, false, []string{}, nil, AnyMap{"origins": []string{server.URL + "/shadow"}})
+	if err != nil {
+		t.Fatal("Could not initialize mirror sidecar")
+	}
+	ux, _ := url.Parse("https://example.com/primary/foo")
+	wrapper := APIWrapper{Request: NewAPIRequest(&http.Request{Method: "POST", URL: ux, Header: http.Header{}}),
+		Response: NewAPIResponse(&http.Response{StatusCode: 200}), Rule: &Rule{Origin: "https://example.com/primary"},
+		Metrics: &APIMetrics{}}
+	wrapper.Request.ExpandedBody = []byte("bar")
+	if !sidecar.IsActive(&wrapper) {
+		t.Error("Mirror sidecar should be active with default sampling")
+	}
+	sidecar.Consume(1)
+	sidecar.GetChannel() <- &wrapper
+	select {
+	case msg := <-received:
+		if msg != "POST /shadow/foo bar" {
+			t.Error("Mirrored request is not what expected: " + msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Shadow origin never received the mirrored request")
+	}
+
+	sidecar, _ = NewMirrorSidecarFromParams(false, 1, false, []string{}, nil, AnyMap{"origins": []string{server.URL}, "sampling": 0})
+	if sidecar.IsActive(&wrapper) {
+		t.Error("Mirror sidecar should never be active with zero sampling")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScriptableSidecar(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	received := make(chan map[string]any, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		payload := map[string]any{}
+		_ = json.NewDecoder(request.Body).Decode(&payload)
+		payload["content-type"] = request.Header.Get("content-type")
+		received <- payload
+		_, _ = writer.Write([]byte("ok"))
+	}))
+	defer webhook.Close()
+
+	dir := t.TempDir()
+	script := `
+	let res = http.request({method: 'post', url: '` + webhook.URL + `',
+		body: {id: transaction.id, status: response.getStatus(), path: request.getPath()}})
+	files.append('events.log', request.getMethod() + ' ' + res.body + '\n')
+	if (typeof request.setHeader !== 'undefined' || typeof transaction.addTag !== 'undefined') {
+		throw new Error('the transaction should be read-only')
+	}
+	`
+	sidecar, err := NewScriptableSidecarFromParams(true, 1, false, nil, nil, AnyMap{"script": script, "dir": dir})
+	if err != nil {
+		t.Fatal("Could not create the scriptable sidecar", err)
+	}
+	request, _ := http.NewRequest("GET", "http://example.com/users", nil)
+	wrapper := APIWrapper{ID: "abc", Request: NewAPIRequest(request), Response: NewAPIResponse(&http.Response{StatusCode: 201})}
+	if err := sidecar.Run(&wrapper); err != nil {
+		t.Fatal("Sidecar script failed", err)
+	}
+	payload := <-received
+	if payload["id"] != "abc" || payload["status"] != float64(201) || payload["path"] != "/users" ||
+		payload["content-type"] != "application/json" {
+		t.Error("Unexpected webhook payload", payload)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "events.log")); string(data) != "GET ok\n" {
+		t.Error("Unexpected file content", string(data))
+	}
+
+	sidecar, _ = NewScriptableSidecarFromParams(true, 1, false, nil, nil, AnyMap{"script": "files.write('../escape.log', 'foo')", "dir": dir})
+	if err := sidecar.Run(&wrapper); err == nil {
+		t.Error("Files outside the directory should not be written")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape.log")); err == nil {
+		t.Error("File written outside the directory")
+	}
+	outside := t.TempDir()
+	_ = os.WriteFile(filepath.Join(outside, "existing.log"), []byte{}, 0644)
+	_ = os.Symlink(filepath.Join(outside, "existing.log"), filepath.Join(dir, "existing.log"))
+	_ = os.Symlink(filepath.Join(outside, "missing.log"), filepath.Join(dir, "missing.log"))
+	_ = os.Symlink(outside, filepath.Join(dir, "linked"))
+	for _, name := range []string{"existing.log", "missing.log", "linked/escape.log"} {
+		sidecar, _ = NewScriptableSidecarFromParams(true, 1, false, nil, nil, AnyMap{"script": "files.write('" + name + "', 'foo')", "dir": dir})
+		if err := sidecar.Run(&wrapper); err == nil {
+			t.Error("Files linking outside the directory should not be written", name)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "existing.log")); len(data) != 0 {
+		t.Error("File written outside the directory through a link")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "missing.log")); err == nil {
+		t.Error("File created outside the directory through a link")
+	}
+
+	// the sidecar runs on its workers
+	sidecar, _ = NewScriptableSidecarFromParams(false, 1, false, nil, nil, AnyMap{"script": "files.append('out.log', transaction.id)", "dir": dir})
+	sidecar.Consume(1)
+	sidecar.GetChannel() <- &wrapper
+	for i := 0; i < 100; i++ {
+		if data, _ := os.ReadFile(filepath.Join(dir, "out.log")); string(data) == "abc" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Messages not consumed")
+}
+
+func TestScriptableSidecar_Redirects(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	hits := 0
+	loop := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		hits++
+		http.Redirect(writer, request, "/loop", http.StatusFound)
+	}))
+	defer loop.Close()
+	sidecar, err := NewScriptableSidecarFromParams(true, 1, false, nil, nil, AnyMap{"script": "http.request({url: '" + loop.URL + "'})"})
+	if err != nil {
+		t.Fatal("Could not create the scriptable sidecar", err)
+	}
+	if sidecar.httpClient.Timeout != time.Second {
+		t.Error("The HTTP calls should be bounded by the script timeout", sidecar.httpClient.Timeout)
+	}
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	wrapper := APIWrapper{Request: NewAPIRequest(request)}
+	if err := sidecar.Run(&wrapper); err == nil {
+		t.Error("Redirect loops should fail the script")
+	}
+	if hits != scriptHTTPMaxRedirects {
+		t.Error("Unexpected number of redirects followed", hits)
+	}
+}
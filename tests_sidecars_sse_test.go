@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEReader(t *testing.T) {
+	stream := ": comment\r\nevent: greeting\r\nid: 1\r\ndata: hello\r\ndata: world\r\n\r\nretry: 100\n\ndata: {\"foo\":\"bar\"}\n\n"
+	events := make([]*SSEEvent, 0)
+	reader := NewSSEReader(io.NopCloser(chunkedReader(stream, 7)), 0, func(event *SSEEvent) {
+		events = append(events, event)
+	})
+	data, _ := io.ReadAll(reader)
+	if string(data) != stream {
+		t.Error("The stream should pass through untouched")
+	}
+	if len(events) != 3 {
+		t.Fatal("Unexpected number of events", len(events))
+	}
+	if events[0].Event != "greeting" || events[0].ID != "1" || events[0].Data != "hello\nworld" {
+		t.Error("Event not parsed correctly", events[0])
+	}
+	if events[1].Retry != 100 || events[2].Data != "{\"foo\":\"bar\"}" {
+		t.Error("Events not parsed correctly", events[1], events[2])
+	}
+
+	events = events[:0]
+	reader = NewSSEReader(io.NopCloser(strings.NewReader("data: 0123456789\n\n")), 10, func(event *SSEEvent) {
+		events = append(events, event)
+	})
+	_, _ = io.ReadAll(reader)
+	if len(events) != 1 || events[0].Data != "0123" {
+		t.Error("Long lines should be truncated", events)
+	}
+}
+
+// chunkedReader returns a reader returning the data in chunks of the given size
+func chunkedReader(data string, size int) io.Reader {
+	reader, writer := io.Pipe()
+	go func() {
+		for len(data) > 0 {
+			n := size
+			if n > len(data) {
+				n = len(data)
+			}
+			_, _ = writer.Write([]byte(data[:n]))
+			data = data[n:]
+		}
+		_ = writer.Close()
+	}()
+	return reader
+}
+
+func TestSSELogSidecar(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	sidecars := NewResponseSidecars(&[]SidecarConfig{{Id: "sse-log", Block: true, Params: AnyMap{"includeData": true}}})
+	if !sidecars.ObservesEvents() {
+		t.Fatal("sse-log should observe the events")
+	}
+	if !sidecars.eventSidecars[0].(*SSELogSidecar).IncludeData {
+		t.Error("sse-log params not decoded")
+	}
+}
+
+func TestReverseProxy_Streaming(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	release := make(chan bool)
+	origin := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("content-type", "text/plain")
+		_, _ = writer.Write([]byte("data: one\n\n"))
+		writer.(http.Flusher).Flush()
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	proxy := httptest.NewUnstartedServer(nil)
+	previous := config
+	t.Cleanup(func() {
+		config = previous
+	})
+	config = LoadConfig("etc/config.yaml")
+	// the global transformers of the sample configuration require authentication
+	config.Before = BeforeAfterConfig{}
+	// the transformer needs the response expanded, which would wait for the whole stream
+	config.Rules = DomainsMap{proxy.Listener.Addr().String(): RoutesMap{"/stream": {Origin: origin.URL, Streaming: true,
+		Response: ResponseConfig{Transformers: []TransformerConfig{{Id: "scriptable",
+			Params: AnyMap{"script": "true", "expandResponse": true}}}}}}}
+	config.Init()
+	proxy.Config.Handler = SetupRouter()
+	proxy.Start()
+	defer proxy.Close()
+
+	response, err := http.Get(proxy.URL + "/stream")
+	if err != nil {
+		t.Fatal("Streaming request failed", err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "data: one\n" {
+			t.Error("Unexpected streamed data", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Streaming responses should be flushed immediately")
+	}
+}
@@ -2,7 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"net/http"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestTempl(t *testing.T) {
@@ -18,6 +27,10 @@ func TestTempl(t *testing.T) {
 		t.Error("Broken template should error out")
 	}
 
+	previous := config
+	t.Cleanup(func() {
+		config = previous
+	})
 	config = Config{}
 	config.Variables = StringMap{"john": "doe"}
 	data, _ = template.Templ(context.Background(), "yay ${Variables.john}", nil)
@@ -28,6 +41,10 @@ func TestTempl(t *testing.T) {
 
 func TestDecodeAndTempl(t *testing.T) {
 	template = NewRPTemplate()
+	previous := config
+	t.Cleanup(func() {
+		config = previous
+	})
 	config = Config{}
 	config.Variables = StringMap{"john": "doe"}
 	data := map[string]any{"Data": "${Variables.john}"}
@@ -51,3 +68,67 @@ func TestDecodeAndTempl(t *testing.T) {
 		t.Error("DecodeAndTempl doesn't seem to work correctly")
 	}
 }
+
+func TestTemplateFunctions(t *testing.T) {
+	template = NewRPTemplate()
+	previous := config
+	t.Cleanup(func() {
+		config = previous
+	})
+	config = Config{}
+	config.Variables = StringMap{"secret": "s3cr3t", "ua": "Chrome/([0-9]+)"}
+	t.Setenv("REDPLANT_TEST", "env")
+	request, _ := http.NewRequest("GET", "http://example.com?page=2", nil)
+	request.Header.Set("x-name", "Foo Bar")
+	request.Header.Set("x-encoded", "Rm9vIEJhcg==")
+	request.Header.Set("user-agent", "Mozilla/5.0 Chrome/120")
+	request.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	response := &http.Response{Header: http.Header{"Set-Cookie": {"token=xyz; Path=/"}}}
+	wrapper := APIWrapper{Request: NewAPIRequest(request), Response: NewAPIResponse(response), RealIP: "1.2.3.4",
+		Claims: &jwt.MapClaims{"sub": "foo", "address": map[string]any{"country": "IT"}}}
+	wrapper.Request.ParsedBody = map[string]any{"items": []any{map[string]any{"name": "a"}}}
+	sum := sha256.Sum256([]byte("Foo Bar"))
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte("Foo Bar"))
+	tests := map[string]string{
+		"${Request.GetQuery(page)}":                                     "2",
+		"${Request.GetCookie(session)}":                                 "abc",
+		"${Response.GetCookie(token)}":                                  "xyz",
+		"${GetClaim(sub)}":                                              "foo",
+		"${GetClaim(address.country)}":                                  "IT",
+		"${Request.GetHeader(x-name).Base64Encode()}":                   "Rm9vIEJhcg==",
+		"${Request.GetHeader(x-encoded).Base64Decode()}":                "Foo Bar",
+		"${Request.GetHeader(x-name).URLEncode()}":                      "Foo+Bar",
+		"${Request.GetHeader(x-name).SHA256()}":                         hex.EncodeToString(sum[:]),
+		"${Request.GetHeader(x-name).HMAC(secret)}":                     hex.EncodeToString(mac.Sum(nil)),
+		"${Request.GetHeader(x-name).HMAC(secret,base64)}":              base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		"${Now(DateOnly,UTC)}":                                          time.Now().UTC().Format("2006-01-02"),
+		"${Request.GetHeader(user-agent).RegexExtract(ua)}":             "120",
+		"${Request.GetHeader(user-agent).RegexReplace(ua,Chromium/$1)}": "Mozilla/5.0 Chromium/120",
+		"${Request.ParsedBody.JSON()}":                                  `{"items":[{"name":"a"}]}`,
+		"${Request.GetHeader(x-name).JSON()}":                           `"Foo Bar"`,
+		"${Request.JSONPath($.items.0.name)}":                           "a",
+		"${Request.GetQuery(missing).Default(1)}":                       "1",
+		"${Request.GetQuery(page).Default(1)}":                          "2",
+		"${Coalesce(Username,RealIP)}":                                  "1.2.3.4",
+		"${Request.GetHeader(x-name).Lower()}":                          "foo bar",
+		"${Request.GetHeader(x-name).Upper()}":                          "FOO BAR",
+		"${Env(REDPLANT_TEST)}":                                         "env",
+	}
+	for templ, expected := range tests {
+		if res, err := template.Templ(context.Background(), templ, &wrapper); err != nil || res != expected {
+			t.Error("Template function not working", templ, res, err)
+		}
+	}
+	res, _ := template.Templ(context.Background(), "${UUID()}", &wrapper)
+	if _, err := uuid.Parse(res); err != nil {
+		t.Error("UUID function not working", res)
+	}
+	res, _ = template.Templ(context.Background(), "${Now(Unix)}", &wrapper)
+	if now, err := strconv.ParseInt(res, 10, 64); err != nil || time.Now().Unix()-now > 1 {
+		t.Error("Now function not working", res)
+	}
+	if _, err := template.Templ(context.Background(), "${Request.GetHeader(x-name).HMAC(missing)}", &wrapper); err == nil {
+		t.Error("HMAC with a missing secret should error out")
+	}
+}
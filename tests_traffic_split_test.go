@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestSplitConfig_Select(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	split := SplitConfig{Sticky: "${Username}", Variants: []*SplitVariant{
+		{Name: "beta", Origin: "https://beta.example.com", Headers: StringMap{"X-Beta": "^true$"}},
+		{Name: "canary", Origin: "https://canary.example.com", Weight: 100},
+	}}
+	if err := split.Init(); err != nil {
+		t.Fatal("Could not initialize split")
+	}
+	ux, _ := url.Parse("https://example.com/foo")
+	wrapper := APIWrapper{Request: NewAPIRequest(&http.Request{URL: ux, Header: http.Header{}}), Context: context.Background(),
+		Username: "foo"}
+	if variant := split.Select(&wrapper); variant == nil || variant.Name != "canary" {
+		t.Error("Weighted variant not selected")
+	}
+	wrapper.Request.Header.Set("X-Beta", "true")
+	if variant := split.Select(&wrapper); variant == nil || variant.Name != "beta" {
+		t.Error("Header-based variant not selected")
+	}
+	wrapper.Request.Header.Del("X-Beta")
+	split.Variants[1].Weight = 50
+	first := split.Select(&wrapper)
+	for i := 0; i < 10; i++ {
+		if split.Select(&wrapper) != first {
+			t.Error("Sticky assignment is not stable")
+		}
+	}
+	split.Variants[1].Weight = 0
+	if split.Select(&wrapper) != nil {
+		t.Error("No variant should be selected with zero weight")
+	}
+}
+
+func TestReplaceOrigin(t *testing.T) {
+	upstream, _ := url.Parse("https://example.com/api/todos/1?foo=bar")
+	origin, _ := url.Parse("https://canary.example.com/v2/")
+	res := replaceOrigin(upstream, "https://example.com/api", origin)
+	if res.String() != "https://canary.example.com/v2/todos/1?foo=bar" {
+		t.Error("Origin replacement failed: " + res.String())
+	}
+}
@@ -18,3 +18,20 @@ func TestDelayTransformer_Transform(t *testing.T) {
 		t.Error("Delay is not working as expected")
 	}
 }
+
+func TestDelayTransformer_TransformDeadline(t *testing.T) {
+	transformer, _ := NewDelayTransformer([]string{}, nil, map[string]any{"min": "1s", "max": "3s"})
+	ux, _ := url.Parse("http://www.example.com")
+	req := ReqWithContext(&http.Request{URL: ux}, nil, &Rule{_timeout: 100 * time.Millisecond})
+	wrapper := GetWrapper(req)
+	defer wrapper.Release()
+	wrapper.Request = NewAPIRequest(req)
+	before := time.Now()
+	_, err := transformer.Transform(wrapper)
+	if time.Since(before).Seconds() >= 1 {
+		t.Error("Delay did not honor the transaction deadline")
+	}
+	if err == nil || !wrapper.TimedOut() {
+		t.Error("Delay did not report the exceeded deadline")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func graphQLWrapper(method string, target string, body string) *APIWrapper {
+	ux, _ := url.Parse(target)
+	req := http.Request{Method: method, Header: http.Header{}, URL: ux}
+	wrapper := APIWrapper{Request: NewAPIRequest(&req), Tags: []string{}}
+	wrapper.Request.ExpandedBody = []byte(body)
+	return &wrapper
+}
+
+func TestGraphQLTransformer_Transform(t *testing.T) {
+	transformer, _ := NewGraphQLTransformer([]string{}, nil, map[string]any{"maxDepth": 3, "maxComplexity": 30})
+	body := `{"query":"query GetUser { user { name friends(first: 5) { ...F } } } fragment F on User { name }"}`
+	wrapper, err := transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", body))
+	if err != nil {
+		t.Error("Valid operation rejected", err)
+	}
+	if !wrapper.HasTag([]string{"graphql-type:query"}) || !wrapper.HasTag([]string{"graphql-op:GetUser"}) {
+		t.Error("Operation not tagged", wrapper.Tags)
+	}
+	body = `{"query":"{ user { friends { friends { name } } } }"}`
+	if _, err = transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", body)); err == nil || err.Error() != "bad_request" {
+		t.Error("Operations exceeding the maximum depth should be rejected", err)
+	}
+	body = `{"query":"query Q($n: Int) { users(first: $n) { name email } }", "variables": {"n": 20}}`
+	if _, err = transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", body)); err == nil {
+		t.Error("Operations exceeding the maximum complexity should be rejected")
+	}
+	wrapper, err = transformer.Transform(graphQLWrapper("GET", "http://www.example.com/graphql?query="+
+		url.QueryEscape("mutation M { a } query Q { b }")+"&operationName=M", ""))
+	if err != nil || !wrapper.HasTag([]string{"graphql-type:mutation"}) {
+		t.Error("GET operations not parsed correctly", err, wrapper.Tags)
+	}
+	if _, err = transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", `{"query":"{ a "}`)); err == nil {
+		t.Error("Invalid queries should be rejected")
+	}
+	body = `{"query":"{ ...A } fragment A on Q { ...A }"}`
+	if _, err = transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", body)); err == nil {
+		t.Error("Fragment cycles should be rejected")
+	}
+}
+
+func TestGraphQLTransformer_Limits(t *testing.T) {
+	transformer, _ := NewGraphQLTransformer([]string{}, nil, map[string]any{"maxComplexity": 100})
+	// the complexity must not overflow, whatever the multipliers
+	for _, first := range []string{"4611686018427387904", "99999999999999999999999"} {
+		body := `{"query":"{ a(first: ` + first + `) { b(first: 3) { c } } }"}`
+		if _, err := transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", body)); err == nil {
+			t.Error("Operations with huge multipliers should be rejected", first)
+		}
+	}
+	// each fragment spreads the next one twice, so walking the spreads would take exponential time
+	query := "{ ...F0 }"
+	for i := 0; i < 24; i++ {
+		query += fmt.Sprintf(" fragment F%d on Q { ...F%d ...F%d }", i, i+1, i+1)
+	}
+	query += " fragment F24 on Q { a }"
+	data, _ := json.Marshal(map[string]string{"query": query})
+	for _, params := range []map[string]any{{"maxComplexity": 100}, {}} {
+		transformer, _ = NewGraphQLTransformer([]string{}, nil, params)
+		start := time.Now()
+		_, err := transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", string(data)))
+		if params["maxComplexity"] != nil && err == nil {
+			t.Error("Fragments fanning out should be rejected")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Error("Fragments should be measured once", params, elapsed)
+		}
+	}
+}
+
+func TestGraphQLTransformer_Allowlist(t *testing.T) {
+	query := "query GetUser { user { name } }"
+	hash := hashGraphQLQuery(query)
+	allowlistPath := filepath.Join(t.TempDir(), "allowlist.json")
+	data, _ := json.Marshal(map[string]string{hash: query})
+	_ = os.WriteFile(allowlistPath, data, 0644)
+	transformer, err := NewGraphQLTransformer([]string{}, nil, map[string]any{"allowlist": allowlistPath})
+	if err != nil {
+		t.Fatal("Could not load the allowlist", err)
+	}
+	if _, err = transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", `{"query":"query GetUser { user { name } }"}`)); err != nil {
+		t.Error("Allowlisted query rejected", err)
+	}
+	_, err = transformer.Transform(graphQLWrapper("POST", "http://www.example.com/graphql", `{"query":"{ user { password } }"}`))
+	if err == nil || !transformer.ErrorMatches(err) {
+		t.Error("Queries not in the allowlist should be rejected", err)
+	}
+	wrapper := graphQLWrapper("POST", "http://www.example.com/graphql", `{"extensions":{"persistedQuery":{"version":1,"sha256Hash":"`+hash+`"}}}`)
+	if _, err = transformer.Transform(wrapper); err != nil || !wrapper.HasTag([]string{"graphql-op:GetUser"}) {
+		t.Error("Persisted query not resolved", err)
+	}
+	sent, _ := io.ReadAll(wrapper.Request.Body)
+	body := map[string]any{}
+	_ = json.Unmarshal(sent, &body)
+	if body["query"] != query || wrapper.Request.ContentLength != int64(len(sent)) {
+		t.Error("Persisted query not sent to the origin", string(sent))
+	}
+	wrapper = graphQLWrapper("POST", "http://www.example.com/graphql", `{"extensions":{"persistedQuery":{"version":1,"sha256Hash":"abc"}}}`)
+	if _, err = transformer.Transform(wrapper); err == nil {
+		t.Error("Unknown persisted queries should be rejected")
+	}
+}
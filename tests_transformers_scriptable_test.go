@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptableTransformer_Transform(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	script := "let seen = typeof leaked\nleaked = true\nrequest.setHeader('x-seen', seen)\n" +
+		"request.getMethod() == 'GET'"
+	transformer, err := NewScriptableTransformer(nil, nil, map[string]any{"script": script, "poolSize": 1})
+	if err != nil {
+		t.Fatal("Could not create the scriptable transformer", err)
+	}
+	if transformer.PoolSize != 1 {
+		t.Error("Script limits not decoded", transformer.ScriptLimits)
+	}
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", "http://example.com", nil)
+		wrapper := APIWrapper{Request: NewAPIRequest(request), Context: context.Background()}
+		if _, err := transformer.Transform(&wrapper); err != nil {
+			t.Fatal("Script failed", err)
+		}
+		// the runtime is reused, but the globals of the previous run must not leak
+		if seen := request.Header.Get("x-seen"); seen != "undefined" {
+			t.Error("Runtime state not reset", i, seen)
+		}
+	}
+	request, _ := http.NewRequest("POST", "http://example.com", nil)
+	wrapper := APIWrapper{Request: NewAPIRequest(request), Context: context.Background()}
+	if _, err := transformer.Transform(&wrapper); err == nil || !transformer.ErrorMatches(err) {
+		t.Error("Script should have rejected the request", err)
+	}
+	if _, err := NewScriptableTransformer(nil, nil, map[string]any{"script": "true +"}); err == nil {
+		t.Error("Scripts should be compiled at construction")
+	}
+	if _, err := NewScriptableTransformer(nil, nil, map[string]any{"script": "true", "errorStatus": 1000}); err == nil {
+		t.Error("Invalid error statuses should be rejected at construction")
+	}
+}
+
+func TestScriptableTransformer_API(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	script := `
+	request.setHeader('x-method', request.getMethod())
+	request.setQuery('page', '2')
+	request.setPath(request.getPath() + '/v2')
+	let body = request.getJSON()
+	body.count++
+	request.setJSON(body)
+	transaction.addTag('scripted')
+	transaction.setVariable('user', request.getQuery('user'))
+	log.info('scripted', {user: request.getQuery('user')})
+	metrics.inc('scripted')
+	response === null
+	`
+	transformer, err := NewScriptableTransformer(nil, nil, map[string]any{"script": script})
+	if err != nil {
+		t.Fatal("Could not create the scriptable transformer", err)
+	}
+	request, _ := http.NewRequest("POST", "http://example.com/users?user=foo", nil)
+	wrapper := APIWrapper{Request: NewAPIRequest(request), Context: context.Background(), Variables: &StringMap{"foo": "bar"}}
+	wrapper.Request.ExpandedBody = []byte(`{"count":1}`)
+	if _, err := transformer.Transform(&wrapper); err != nil {
+		t.Fatal("Script failed", err)
+	}
+	if request.Header.Get("x-method") != "POST" || request.URL.String() != "http://example.com/users/v2?page=2&user=foo" {
+		t.Error("Request not modified", request.Header, request.URL.String())
+	}
+	if data, _ := io.ReadAll(request.Body); string(data) != `{"count":2}` || request.ContentLength != 11 {
+		t.Error("Request body not modified", string(data))
+	}
+	if !wrapper.HasTag([]string{"scripted"}) || (*wrapper.Variables)["user"] != "foo" || (*wrapper.Variables)["foo"] != "bar" {
+		t.Error("Tags and variables not set", wrapper.Tags, wrapper.Variables)
+	}
+
+	script = `
+	if (response.getStatus() == 404) {
+		respond(400, {error: 'not found'}, {'x-reason': 'missing'})
+	}
+	response.setStatus(201)
+	response.setBody(response.getBody().toUpperCase())
+	true
+	`
+	transformer, _ = NewScriptableTransformer(nil, nil, map[string]any{"script": script})
+	wrapper.Response = NewAPIResponse(&http.Response{StatusCode: 200, Header: http.Header{"Content-Length": {"3"}}})
+	wrapper.Response.ExpandedBody = []byte("foo")
+	if _, err := transformer.Transform(&wrapper); err != nil {
+		t.Fatal("Script failed", err)
+	}
+	if data, _ := io.ReadAll(wrapper.Response.Body); string(data) != "FOO" || wrapper.Response.StatusCode != 201 {
+		t.Error("Response not modified", string(data), wrapper.Response.StatusCode)
+	}
+	wrapper.Response.StatusCode = 404
+	_, err = transformer.Transform(&wrapper)
+	scriptResponse, ok := err.(*ScriptResponse)
+	if !ok {
+		t.Fatal("Script should have responded", err)
+	}
+	recorder := httptest.NewRecorder()
+	scriptResponse.Write(recorder)
+	if recorder.Code != 400 || recorder.Header().Get("x-reason") != "missing" ||
+		recorder.Header().Get("content-type") != "application/json" || strings.TrimSpace(recorder.Body.String()) != `{"error":"not found"}` {
+		t.Error("Unexpected script response", recorder.Code, recorder.Header(), recorder.Body.String())
+	}
+}
+
+func TestScriptableTransformer_Wrapper(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	// the deprecated wrapper global keeps working for the scripts written before the JavaScript API
+	script := "wrapper.Request.Header.Set('x-legacy', wrapper.Request.Method + ' ' + wrapper.Request.URL.Path)\n" +
+		"wrapper.ID == 'abc' && wrapper.Context === undefined && wrapper.Clone === undefined"
+	transformer, err := NewScriptableTransformer(nil, nil, map[string]any{"script": script})
+	if err != nil {
+		t.Fatal("Could not create the scriptable transformer", err)
+	}
+	request, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+	wrapper := APIWrapper{ID: "abc", Request: NewAPIRequest(request), Context: context.Background()}
+	if _, err := transformer.Transform(&wrapper); err != nil {
+		t.Error("Script failed", err)
+	}
+	if request.Header.Get("x-legacy") != "GET /foo" {
+		t.Error("Request not modified through the wrapper", request.Header)
+	}
+}
+
+func TestScriptableTransformer_APIErrors(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	scripts := map[string]string{
+		"negative counter":    "metrics.add('scripted', -1)\ntrue",
+		"NaN counter":         "metrics.add('scripted', NaN)\ntrue",
+		"invalid respond":     "respond(1000, 'foo')\ntrue",
+		"invalid response":    "response.setStatus(42)\ntrue",
+		"respond below range": "respond(99)\ntrue",
+	}
+	for name, script := range scripts {
+		transformer, err := NewScriptableTransformer(nil, nil, map[string]any{"script": script, "poolSize": 1})
+		if err != nil {
+			t.Fatal("Could not create the scriptable transformer", err)
+		}
+		request, _ := http.NewRequest("GET", "http://example.com", nil)
+		wrapper := APIWrapper{Request: NewAPIRequest(request), Response: NewAPIResponse(&http.Response{StatusCode: 200})}
+		_, err = transformer.Transform(&wrapper)
+		if response, ok := err.(*ScriptResponse); !ok || response.Status != 500 {
+			t.Error("Invalid values should make the script fail", name, err)
+		}
+		if wrapper.Response.StatusCode != 200 {
+			t.Error("Invalid status codes should not be set", name, wrapper.Response.StatusCode)
+		}
+	}
+}
+
+func TestScriptableTransformer_Limits(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	scripts := map[string]string{
+		"timeout":         "while (true) {}",
+		"stack overflow":  "function f() { return f() }\nf()",
+		"not a boolean":   "'true'",
+		"wrapper methods": "wrapper.Release()\ntrue",
+		"wrapper fields":  "wrapper.ResponseWriter.WriteHeader(200)\ntrue",
+	}
+	for name, script := range scripts {
+		transformer, err := NewScriptableTransformer(nil, nil, map[string]any{"script": script, "timeout": "50ms", "errorStatus": 502})
+		if err != nil {
+			t.Fatal("Could not create the scriptable transformer", err)
+		}
+		request, _ := http.NewRequest("GET", "http://example.com", nil)
+		wrapper := APIWrapper{Request: NewAPIRequest(request), Context: context.Background()}
+		start := time.Now()
+		_, err = transformer.Transform(&wrapper)
+		if response, ok := err.(*ScriptResponse); !ok || response.Status != 502 {
+			t.Error("Script failures should end with the error status", name, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Error("Script not interrupted", name)
+		}
+	}
+}
+
+func TestScriptPool(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	pool, _ := NewScriptPool("loop", "while (true) {}", ScriptLimits{PoolSize: 1}, NewSTLogHelper(nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Run(ctx, nil); err == nil {
+		t.Error("Scripts should be interrupted when the context is done")
+	}
+	// the interrupted runtime is discarded, but its slot is freed
+	vm := <-pool.runtimes
+	if vm != nil {
+		t.Error("Failed runtimes should not be reused")
+	}
+	if _, err := pool.Run(ctx, nil); err != context.DeadlineExceeded {
+		t.Error("Runs should not wait for a runtime past the context", err)
+	}
+	pool, _ = NewScriptPool("panic", "boom()", ScriptLimits{PoolSize: 1}, NewSTLogHelper(nil))
+	boom := map[string]any{"boom": func() { panic("boom") }}
+	if _, err := pool.Run(context.Background(), boom); err == nil || err.Error() != "script panicked: boom" {
+		t.Error("Panics of the Go functions should be returned as errors", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Run(ctx, map[string]any{"boom": func() {}}); err != nil {
+		t.Error("Runtimes should be returned to the pool after a panic", err)
+	}
+}
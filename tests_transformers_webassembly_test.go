@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// wasmTestImports are the host functions imported by the test plugins, in the order of their function indexes
+var wasmTestImports = []struct {
+	name    string
+	params  int
+	results int
+}{
+	{"get_header", 5, 1},
+	{"set_header", 5, 0},
+	{"delete_header", 3, 0},
+	{"get_body", 3, 1},
+	{"set_body", 3, 0},
+	{"get_status", 0, 1},
+	{"set_status", 1, 0},
+	{"has_tag", 2, 1},
+	{"add_tag", 2, 0},
+	{"log", 2, 0},
+}
+
+// wasmTestModule assembles a plugin importing all the host functions, with data at offset 0 of its memory, and a
+// transform function running the given code
+func wasmTestModule(code []byte, data string) []byte {
+	uleb := func(v int) []byte {
+		var res []byte
+		for {
+			b := byte(v & 0x7f)
+			v >>= 7
+			if v == 0 {
+				return append(res, b)
+			}
+			res = append(res, b|0x80)
+		}
+	}
+	vec := func(items ...[]byte) []byte {
+		res := uleb(len(items))
+		for _, item := range items {
+			res = append(res, item...)
+		}
+		return res
+	}
+	name := func(s string) []byte {
+		return append(uleb(len(s)), s...)
+	}
+	section := func(id byte, content []byte) []byte {
+		return append(append([]byte{id}, uleb(len(content))...), content...)
+	}
+	funcType := func(params int, results int) []byte {
+		res := append([]byte{0x60}, uleb(params)...)
+		for i := 0; i < params; i++ {
+			res = append(res, 0x7f)
+		}
+		res = append(res, uleb(results)...)
+		for i := 0; i < results; i++ {
+			res = append(res, 0x7f)
+		}
+		return res
+	}
+	var types, imports [][]byte
+	for i, imp := range wasmTestImports {
+		types = append(types, funcType(imp.params, imp.results))
+		imports = append(imports, append(append(name("redplant"), name(imp.name)...), append([]byte{0x00}, uleb(i)...)...))
+	}
+	transform := uleb(len(wasmTestImports))
+	types = append(types, funcType(0, 1))
+	body := append(append([]byte{0x00}, code...), 0x0b)
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1, vec(types...))...)
+	module = append(module, section(2, vec(imports...))...)
+	module = append(module, section(3, vec(transform))...)
+	module = append(module, section(5, vec([]byte{0x00, 0x01}))...)
+	module = append(module, section(7, vec(append(name("memory"), 0x02, 0x00), append(append(name("transform"), 0x00), transform...)))...)
+	module = append(module, section(10, vec(append(uleb(len(body)), body...)))...)
+	module = append(module, section(11, vec(append([]byte{0x00, 0x41, 0x00, 0x0b}, name(data)...)))...)
+	return module
+}
+
+// wasmI32 is the i32.const instruction for each value. The values are encoded on two bytes, so they must be lower
+// than 8192
+func wasmI32(values ...int) []byte {
+	var res []byte
+	for _, v := range values {
+		res = append(res, 0x41, byte(v&0x7f), byte(v>>7))
+		res[len(res)-2] |= 0x80
+	}
+	return res
+}
+
+// wasmCall is the call instruction, to the host function with the given name
+func wasmCall(fn string) []byte {
+	for i, imp := range wasmTestImports {
+		if imp.name == fn {
+			return []byte{0x10, byte(i)}
+		}
+	}
+	panic("unknown host function " + fn)
+}
+
+// newTestWasmTransformer writes the plugin to a file and creates a transformer running it
+func newTestWasmTransformer(t *testing.T, module []byte, params map[string]any) *WasmTransformer {
+	path := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(path, module, 0644); err != nil {
+		t.Fatal(err)
+	}
+	params["path"] = path
+	transformer, err := NewWasmTransformer(nil, nil, params)
+	if err != nil {
+		t.Fatal("Could not create the wasm transformer", err)
+	}
+	return transformer
+}
+
+func concatCode(parts ...[]byte) []byte {
+	var res []byte
+	for _, part := range parts {
+		res = append(res, part...)
+	}
+	return res
+}
+
+func TestWasmTransformer_Request(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	// offsets: x-plugin 0, wasm 8, x-in 12, x-out 16, x-del 21, blocked 26. The buffer is at 1024
+	data := "x-pluginwasmx-inx-outx-delblocked"
+	code := concatCode(
+		wasmI32(0, 0, 8, 8, 4), wasmCall("set_header"),
+		wasmI32(0, 16, 5, 1024), wasmI32(0, 12, 4, 1024, 64), wasmCall("get_header"), wasmCall("set_header"),
+		wasmI32(0, 21, 5), wasmCall("delete_header"),
+		wasmI32(8, 4), wasmCall("add_tag"),
+		wasmI32(8, 4), wasmCall("log"),
+		wasmI32(26, 7), wasmCall("has_tag"),
+	)
+	transformer := newTestWasmTransformer(t, wasmTestModule(code, data), map[string]any{"poolSize": 1})
+	// the same instance serves both transactions
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", "http://example.com", nil)
+		request.Header.Set("x-in", "foo")
+		request.Header.Set("x-del", "bar")
+		wrapper := APIWrapper{Request: NewAPIRequest(request)}
+		if _, err := transformer.Transform(&wrapper); err != nil {
+			t.Fatal("Plugin failed", err)
+		}
+		if request.Header.Get("x-plugin") != "wasm" || request.Header.Get("x-out") != "foo" || request.Header.Get("x-del") != "" {
+			t.Error("Request headers not modified", request.Header)
+		}
+		if !wrapper.HasTag([]string{"wasm"}) {
+			t.Error("Tag not added", wrapper.Tags)
+		}
+	}
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("x-in", "foo")
+	wrapper := APIWrapper{Request: NewAPIRequest(request), Tags: []string{"blocked"}}
+	_, err := transformer.Transform(&wrapper)
+	if err == nil || !transformer.ErrorMatches(err) {
+		t.Fatal("Plugin should have rejected the request", err)
+	}
+	recorder := httptest.NewRecorder()
+	var writer http.ResponseWriter = recorder
+	transformer.HandleError(&writer)
+	if recorder.Code != 403 {
+		t.Error("Wrong reject status", recorder.Code)
+	}
+}
+
+func TestWasmTransformer_Response(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	code := concatCode(
+		wasmCall("get_status"), []byte{0x41, 0x01, 0x6a}, wasmCall("set_status"),
+		wasmI32(1, 1024), wasmI32(0, 1024, 64), wasmCall("get_body"), wasmCall("set_body"),
+		wasmI32(1, 0, 8, 8, 4), wasmCall("set_header"),
+		wasmI32(0),
+	)
+	transformer := newTestWasmTransformer(t, wasmTestModule(code, "x-pluginwasm"), map[string]any{})
+	request, _ := http.NewRequest("POST", "http://example.com", nil)
+	wrapper := APIWrapper{Request: NewAPIRequest(request),
+		Response: NewAPIResponse(&http.Response{StatusCode: 200, Header: http.Header{"Content-Encoding": {"gzip"}}})}
+	wrapper.Request.ExpandedBody = []byte("hello")
+	if _, err := transformer.Transform(&wrapper); err != nil {
+		t.Fatal("Plugin failed", err)
+	}
+	response := wrapper.Response
+	if response.StatusCode != 201 || response.Header.Get("x-plugin") != "wasm" {
+		t.Error("Response not modified", response.StatusCode, response.Header)
+	}
+	if data, _ := io.ReadAll(response.Body); string(data) != "hello" || response.ContentLength != 5 ||
+		response.Header.Get("content-encoding") != "" {
+		t.Error("Response body not modified", string(data), response.Header)
+	}
+	// status codes that can't be written to the client are ignored
+	invalid := newTestWasmTransformer(t, wasmTestModule(concatCode(wasmI32(1000), wasmCall("set_status"), wasmI32(0)), ""),
+		map[string]any{})
+	if _, err := invalid.Transform(&wrapper); err != nil || wrapper.Response.StatusCode != 201 {
+		t.Error("Invalid status codes should be ignored", err, wrapper.Response.StatusCode)
+	}
+	// on the request side there's no response, so the response functions do nothing
+	wrapper.Response = nil
+	if _, err := transformer.Transform(&wrapper); err != nil {
+		t.Error("Plugin failed without a response", err)
+	}
+}
+
+func TestWasmTransformer_Failures(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	loop := []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x41, 0x00}
+	outOfRange := concatCode(wasmI32(0, 0, 8), []byte{0x41, 0x80, 0x80, 0x08}, wasmI32(4), wasmCall("set_header"), wasmI32(0))
+	for name, code := range map[string][]byte{"loop": loop, "trap": {0x00, 0x41, 0x00}, "out of range": outOfRange} {
+		transformer := newTestWasmTransformer(t, wasmTestModule(code, "x-plugin"),
+			map[string]any{"poolSize": 1, "timeout": "50ms", "errorStatus": 502})
+		// the failed instances are discarded, so the slot is available to the next transaction
+		for i := 0; i < 2; i++ {
+			request, _ := http.NewRequest("GET", "http://example.com", nil)
+			wrapper := APIWrapper{Request: NewAPIRequest(request)}
+			_, err := transformer.Transform(&wrapper)
+			var response *ScriptResponse
+			if !errors.As(err, &response) || response.Status != 502 {
+				t.Error("Plugin should have failed", name, err)
+			}
+		}
+	}
+	for _, params := range []map[string]any{{"rejectStatus": 1000}, {"errorStatus": 42}} {
+		path := filepath.Join(t.TempDir(), "plugin.wasm")
+		_ = os.WriteFile(path, wasmTestModule(wasmI32(0), ""), 0644)
+		params["path"] = path
+		if _, err := NewWasmTransformer(nil, nil, params); err == nil {
+			t.Error("Invalid status codes should be rejected at construction", params)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "plugin.wasm")
+	_ = os.WriteFile(path, []byte("not wasm"), 0644)
+	if _, err := NewWasmTransformer(nil, nil, map[string]any{"path": path}); err == nil {
+		t.Error("Modules should be compiled at construction")
+	}
+}
@@ -5,16 +5,79 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestFileTrip(t *testing.T) {
-	req := http.Request{}
+	rule := Rule{Origin: "file://etc/files"}
+	req := http.Request{Method: "GET", Header: http.Header{}}
 	req.URL, _ = url.Parse("file://etc/files/data.json")
-	res, _ := FileTrip(&req)
+	res, _ := FileTrip(&req, &rule)
 	data1, _ := io.ReadAll(res.Body)
 	data2, _ := os.ReadFile("etc/files/data.json")
 	if string(data1) != string(data2) {
 		t.Error("File tripper does not work according to plan")
 	}
+	if !strings.HasPrefix(res.Header.Get("content-type"), "application/json") {
+		t.Error("File tripper did not detect the content type by extension")
+	}
+
+	req.Header.Set("If-None-Match", res.Header.Get("etag"))
+	res, _ = FileTrip(&req, &rule)
+	if res.StatusCode != 304 {
+		t.Error("File tripper did not honor the ETag")
+	}
+	req.Header.Del("If-None-Match")
+
+	req.Header.Set("Range", "bytes=0-1")
+	res, _ = FileTrip(&req, &rule)
+	data1, _ = io.ReadAll(res.Body)
+	if res.StatusCode != 206 || string(data1) != string(data2[0:2]) {
+		t.Error("File tripper did not honor the range")
+	}
+	req.Header.Del("Range")
+
+	req.URL, _ = url.Parse("file://etc/files/missing.json")
+	res, _ = FileTrip(&req, &rule)
+	if res.StatusCode != 404 {
+		t.Error("File tripper did not return 404 for a missing file")
+	}
+
+	req.URL, _ = url.Parse("file://etc/files/../config.yaml")
+	res, _ = FileTrip(&req, &rule)
+	if res.StatusCode != 403 {
+		t.Error("File tripper allowed escaping the root directory")
+	}
+
+	req.URL, _ = url.Parse("file://etc/files/")
+	res, _ = FileTrip(&req, &rule)
+	if res.StatusCode != 404 {
+		t.Error("File tripper should not list directories by default")
+	}
+	rule.File = &FileConfig{Listing: true}
+	res, _ = FileTrip(&req, &rule)
+	data1, _ = io.ReadAll(res.Body)
+	if res.StatusCode != 200 || !strings.Contains(string(data1), "data.json") {
+		t.Error("File tripper did not list the directory")
+	}
+	rule.File = &FileConfig{Index: []string{"data.txt"}}
+	res, _ = FileTrip(&req, &rule)
+	data1, _ = io.ReadAll(res.Body)
+	data2, _ = os.ReadFile("etc/files/data.txt")
+	if string(data1) != string(data2) {
+		t.Error("File tripper did not serve the index file")
+	}
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	_ = os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	_ = os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "index.html"))
+	rule = Rule{Origin: "file://" + root, File: &FileConfig{Index: []string{"index.html"}}}
+	req.URL, _ = url.Parse("file://" + root + "/")
+	res, _ = FileTrip(&req, &rule)
+	if res.StatusCode != 403 {
+		t.Error("File tripper allowed an index file escaping the root directory", res.StatusCode)
+	}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func newTestRestRule() *Rule {
+	database := &DBConfig{Rest: &DBRestConfig{Tables: map[string]*DBRestTable{"notes": {
+		Columns: []string{"id", "owner", "title", "tags"},
+		Filters: StringMap{"owner": "${Claims.sub}"}}}}}
+	_ = database.Init()
+	rule := Rule{Origin: "sqlite:///:memory:", Database: database}
+	rule.db, _ = sqlx.Open("sqlite", ":memory:")
+	rule.db.SetMaxOpenConns(1)
+	rule.db.MustExec("CREATE TABLE notes (id INTEGER PRIMARY KEY, owner TEXT, title TEXT, tags TEXT, secret TEXT)")
+	rule.db.MustExec("INSERT INTO notes VALUES (1, 'alice', 'one', NULL, 'x'), (2, 'alice', 'two', NULL, 'x'), (3, 'bob', 'three', NULL, 'x')")
+	return &rule
+}
+
+func restTrip(t *testing.T, rule *Rule, method string, target string, vars map[string]string, body any, sub string) (int, string) {
+	request, _ := http.NewRequest(method, target, nil)
+	wrapper := APIWrapper{Rule: rule, Request: NewAPIRequest(request), Context: context.Background()}
+	wrapper.Request.UrlVars = vars
+	wrapper.Request.ParsedBody = body
+	if sub != "" {
+		wrapper.Claims = &jwt.MapClaims{"sub": sub}
+	}
+	response, err := DBTrip(request, &wrapper)
+	if err != nil {
+		t.Fatal("REST request failed", err)
+	}
+	data, _ := io.ReadAll(response.Body)
+	return response.StatusCode, string(data)
+}
+
+func TestDBRestConfig_Init(t *testing.T) {
+	cfg := DBRestConfig{Tables: map[string]*DBRestTable{"notes": {Columns: []string{"id", "title; DROP TABLE notes"}}}}
+	if cfg.Init() == nil {
+		t.Error("Invalid column names should not be accepted")
+	}
+	cfg = DBRestConfig{Tables: map[string]*DBRestTable{"notes": {}}}
+	if cfg.Init() == nil {
+		t.Error("Tables with no columns should not be accepted")
+	}
+}
+
+func TestDBRestTrip(t *testing.T) {
+	template = NewRPTemplate()
+	rule := newTestRestRule()
+	defer func() {
+		_ = rule.db.Close()
+	}()
+	notes := map[string]string{"table": "notes"}
+	status, data := restTrip(t, rule, "GET", "sqlite:///:memory:/notes", notes, nil, "alice")
+	if status != 200 || data != "[{\"id\":1,\"owner\":\"alice\",\"tags\":null,\"title\":\"one\"},{\"id\":2,\"owner\":\"alice\",\"tags\":null,\"title\":\"two\"}]" {
+		t.Error("Unexpected list", status, data)
+	}
+	_, data = restTrip(t, rule, "GET", "sqlite:///:memory:/notes?title=like.t%25&secret=y", notes, nil, "alice")
+	if data != "[{\"id\":2,\"owner\":\"alice\",\"tags\":null,\"title\":\"two\"}]" {
+		t.Error("Unexpected filtered list", data)
+	}
+	if status, _ = restTrip(t, rule, "GET", "sqlite:///:memory:/notes", notes, nil, ""); status != 403 {
+		t.Error("Requests with empty row filters should be forbidden", status)
+	}
+	if status, _ = restTrip(t, rule, "GET", "sqlite:///:memory:/secrets", map[string]string{"table": "secrets"}, nil, "alice"); status != 404 {
+		t.Error("Tables not in the allowlist should not be found", status)
+	}
+	status, data = restTrip(t, rule, "GET", "sqlite:///:memory:/notes/1", map[string]string{"table": "notes", "id": "1"}, nil, "alice")
+	if status != 200 || data != "{\"id\":1,\"owner\":\"alice\",\"tags\":null,\"title\":\"one\"}" {
+		t.Error("Unexpected row", status, data)
+	}
+	if status, _ = restTrip(t, rule, "GET", "sqlite:///:memory:/notes/3", map[string]string{"table": "notes", "id": "3"}, nil, "alice"); status != 404 {
+		t.Error("Rows outside the row filters should not be found", status)
+	}
+	status, _ = restTrip(t, rule, "POST", "sqlite:///:memory:/notes", notes,
+		map[string]any{"id": 4.0, "title": "four", "owner": "bob", "tags": []any{"a"}}, "alice")
+	if status != 201 {
+		t.Error("Row not inserted", status)
+	}
+	if status, _ = restTrip(t, rule, "POST", "sqlite:///:memory:/notes", notes, map[string]any{"secret": "y"}, "alice"); status != 400 {
+		t.Error("Columns not in the allowlist should not be writable", status)
+	}
+	_, data = restTrip(t, rule, "GET", "sqlite:///:memory:/notes/4", map[string]string{"table": "notes", "id": "4"}, nil, "alice")
+	if data != "{\"id\":4,\"owner\":\"alice\",\"tags\":\"[\\\"a\\\"]\",\"title\":\"four\"}" {
+		t.Error("Row filters should override the inserted values", data)
+	}
+	if status, _ = restTrip(t, rule, "PATCH", "sqlite:///:memory:/notes/3", map[string]string{"table": "notes", "id": "3"},
+		map[string]any{"title": "mine"}, "alice"); status != 404 {
+		t.Error("Rows outside the row filters should not be updated", status)
+	}
+	if status, _ = restTrip(t, rule, "PATCH", "sqlite:///:memory:/notes/4", map[string]string{"table": "notes", "id": "4"},
+		map[string]any{"title": "updated"}, "alice"); status != 204 {
+		t.Error("Row not updated", status)
+	}
+	if status, _ = restTrip(t, rule, "PATCH", "sqlite:///:memory:/notes/4", map[string]string{"table": "notes", "id": "4"},
+		map[string]any{"id": 9.0, "title": "renamed"}, "alice"); status != 204 {
+		t.Error("Row not updated", status)
+	}
+	_, data = restTrip(t, rule, "GET", "sqlite:///:memory:/notes/4", map[string]string{"table": "notes", "id": "4"}, nil, "alice")
+	if data != "{\"id\":4,\"owner\":\"alice\",\"tags\":\"[\\\"a\\\"]\",\"title\":\"renamed\"}" {
+		t.Error("The key of the rows should not be updated", data)
+	}
+	if status, _ = restTrip(t, rule, "PATCH", "sqlite:///:memory:/notes/4", map[string]string{"table": "notes", "id": "4"},
+		map[string]any{"id": 9.0}, "alice"); status != 400 {
+		t.Error("Updates of the key alone should be rejected", status)
+	}
+	if status, _ = restTrip(t, rule, "DELETE", "sqlite:///:memory:/notes/4", map[string]string{"table": "notes", "id": "4"}, nil, "alice"); status != 204 {
+		t.Error("Row not deleted", status)
+	}
+	if status, _ = restTrip(t, rule, "DELETE", "sqlite:///:memory:/notes", notes, nil, "alice"); status != 405 {
+		t.Error("Collections should not be deleted", status)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDBQuery_BindValues(t *testing.T) {
+	template = NewRPTemplate()
+	cfg := DBConfig{Queries: map[string]*DBQuery{"get": {Statement: "SELECT * FROM users WHERE id = :id AND kind = :kind",
+		Params: StringMap{"id": "${Request.UrlVars.id}", "kind": "${Request.GetQuery(kind)}"}}}}
+	if cfg.FindQuery("POST") != nil || cfg.IsRawSQL() {
+		t.Error("Unexpected query configuration")
+	}
+	query := cfg.FindQuery("GET")
+	if query == nil {
+		t.Fatal("Named query not found by method")
+	}
+	ux, _ := url.Parse("postgres://localhost/users/1?kind=admin")
+	wrapper := APIWrapper{Request: NewAPIRequest(&http.Request{URL: ux}), Context: context.Background()}
+	wrapper.Request.UrlVars = map[string]string{"id": "1"}
+	values, _ := query.BindValues(&wrapper)
+	if values["id"] != "1" || values["kind"] != "admin" {
+		t.Error("Bind values not evaluated correctly")
+	}
+}
+
+func TestToJSONValue(t *testing.T) {
+	ts := time.Date(2022, 3, 4, 10, 11, 12, 0, time.UTC)
+	cases := []struct {
+		typeName string
+		value    any
+		expected string
+	}{
+		// Postgres
+		{"INT4", int64(42), "42"},
+		{"INT8", nil, "null"},
+		{"FLOAT8", 1.5, "1.5"},
+		{"NUMERIC", []byte("12.340"), "12.340"},
+		{"BOOL", true, "true"},
+		{"TEXT", "foo", "\"foo\""},
+		{"UUID", []byte("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"), "\"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11\""},
+		{"JSONB", []byte("{\"foo\":[1,2]}"), "{\"foo\":[1,2]}"},
+		{"TIMESTAMPTZ", ts, "\"2022-03-04T10:11:12Z\""},
+		{"DATE", ts, "\"2022-03-04\""},
+		{"BYTEA", []byte{0, 1, 2}, "\"AAEC\""},
+		{"_INT4", []byte("{1,NULL,3}"), "[1,null,3]"},
+		{"_TEXT", []byte("{foo,\"bar baz\",\"q\\\"t\"}"), "[\"foo\",\"bar baz\",\"q\\\"t\"]"},
+		{"_BOOL", []byte("{{t,f},{f,t}}"), "[[true,false],[false,true]]"},
+		// SQLite
+		{"BOOLEAN", int64(1), "true"},
+		{"INTEGER", int64(1), "1"},
+		// MySQL
+		{"INT", []byte("42"), "42"},
+		{"UNSIGNED BIGINT", []byte("18446744073709551615"), "18446744073709551615"},
+		{"DECIMAL", []byte("3.14"), "3.14"},
+		{"DOUBLE", []byte("2.5"), "2.5"},
+		{"VARCHAR", []byte("foo"), "\"foo\""},
+		{"JSON", []byte("{\"foo\":true}"), "{\"foo\":true}"},
+		{"DATETIME", []byte("2022-03-04 10:11:12"), "\"2022-03-04T10:11:12Z\""},
+		{"DATE", []byte("2022-03-04"), "\"2022-03-04\""},
+		{"BLOB", []byte{0, 1, 2}, "\"AAEC\""},
+		{"BIT", []byte{1, 0}, "256"},
+		{"TINYINT", nil, "null"},
+	}
+	for _, c := range cases {
+		data, err := json.Marshal(toJSONValue(c.typeName, c.value))
+		if err != nil || string(data) != c.expected {
+			t.Error("Wrong conversion for " + c.typeName + ": " + string(data))
+		}
+	}
+}
+
+func TestDBTrip_SQLite(t *testing.T) {
+	template = NewRPTemplate()
+	driver, dsn, err := parseDatabaseURI("sqlite:///:memory:")
+	if err != nil || driver != "sqlite" || dsn != ":memory:" {
+		t.Fatal("SQLite URI not parsed correctly", driver, dsn, err)
+	}
+	rule := Rule{Origin: "sqlite:///:memory:", Database: &DBConfig{Queries: map[string]*DBQuery{"get": {
+		Statement: "SELECT * FROM users WHERE id = :id",
+		Params:    StringMap{"id": "${Request.UrlVars.id}"}}}}}
+	rule.db, _ = sqlx.Open(driver, dsn)
+	rule.db.SetMaxOpenConns(1)
+	defer func() {
+		_ = rule.db.Close()
+	}()
+	rule.db.MustExec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL, active BOOLEAN, meta BLOB)")
+	rule.db.MustExec("INSERT INTO users VALUES (1, 'foo', 1.5, true, NULL)")
+	request, _ := http.NewRequest("GET", "sqlite:///:memory:/users/1", nil)
+	wrapper := APIWrapper{Rule: &rule, Request: NewAPIRequest(request), Context: context.Background()}
+	wrapper.Request.UrlVars = map[string]string{"id": "1"}
+	response, err := DBTrip(request, &wrapper)
+	if err != nil {
+		t.Fatal("Could not query the database", err)
+	}
+	data, _ := io.ReadAll(response.Body)
+	if string(data) != "[{\"active\":true,\"id\":1,\"meta\":null,\"name\":\"foo\",\"score\":1.5}]" {
+		t.Error("Unexpected database response", string(data))
+	}
+	request, _ = http.NewRequest("DELETE", "sqlite:///:memory:/users/1", nil)
+	response, _ = DBTrip(request, &wrapper)
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Unconfigured methods should not be allowed")
+	}
+}
+
+func newTestSQLiteRule(database *DBConfig) *Rule {
+	rule := Rule{Origin: "sqlite:///:memory:", Database: database}
+	_ = database.Init()
+	rule.db, _ = sqlx.Open("sqlite", ":memory:")
+	rule.db.SetMaxOpenConns(1)
+	rule.db.MustExec("CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	for i := 1; i <= 5; i++ {
+		rule.db.MustExec("INSERT INTO items VALUES (?, ?)", i, fmt.Sprintf("item, %d", i))
+	}
+	return &rule
+}
+
+func dbTripBody(t *testing.T, rule *Rule, target string, accept string) (*http.Response, string) {
+	request, _ := http.NewRequest("GET", target, nil)
+	request.Header.Set("accept", accept)
+	wrapper := APIWrapper{Rule: rule, Request: NewAPIRequest(request), Context: context.Background()}
+	response, err := DBTrip(request, &wrapper)
+	if err != nil {
+		t.Fatal("Could not query the database", err)
+	}
+	data, _ := io.ReadAll(response.Body)
+	return response, string(data)
+}
+
+func TestDBTrip_Formats(t *testing.T) {
+	template = NewRPTemplate()
+	rule := newTestSQLiteRule(&DBConfig{MaxRows: 2, Queries: map[string]*DBQuery{"get": {Statement: "SELECT * FROM items ORDER BY id"}}})
+	defer func() {
+		_ = rule.db.Close()
+	}()
+	response, data := dbTripBody(t, rule, "sqlite:///:memory:/items", "application/x-ndjson")
+	if response.Header.Get("content-type") != dbFormatNDJSON || data != "{\"id\":1,\"name\":\"item, 1\"}\n{\"id\":2,\"name\":\"item, 2\"}\n" {
+		t.Error("Unexpected NDJSON response", data)
+	}
+	response, data = dbTripBody(t, rule, "sqlite:///:memory:/items", "text/html, text/csv;q=0.9")
+	if response.Header.Get("content-type") != dbFormatCSV || data != "id,name\n1,\"item, 1\"\n2,\"item, 2\"\n" {
+		t.Error("Unexpected CSV response", data)
+	}
+	response, data = dbTripBody(t, rule, "sqlite:///:memory:/items", "*/*")
+	if response.Header.Get("content-type") != dbFormatJSON || data != "[{\"id\":1,\"name\":\"item, 1\"},{\"id\":2,\"name\":\"item, 2\"}]" {
+		t.Error("Unexpected JSON response", data)
+	}
+}
+
+func TestDBTrip_Pagination(t *testing.T) {
+	template = NewRPTemplate()
+	rule := newTestSQLiteRule(&DBConfig{Pagination: &DBPagination{Limit: 2},
+		Queries: map[string]*DBQuery{"get": {Statement: "SELECT id FROM items ORDER BY id LIMIT :limit OFFSET :offset"}}})
+	response, data := dbTripBody(t, rule, "sqlite:///:memory:/items?offset=2&foo=bar", "")
+	if data != "[{\"id\":3},{\"id\":4}]" {
+		t.Error("Unexpected page", data)
+	}
+	if response.Header.Get("link") != "<?foo=bar&limit=2&offset=4>; rel=\"next\", <?foo=bar&limit=2&offset=0>; rel=\"prev\"" {
+		t.Error("Unexpected links", response.Header.Get("link"))
+	}
+	response, data = dbTripBody(t, rule, "sqlite:///:memory:/items?offset=4&limit=500", "")
+	if data != "[{\"id\":5}]" || response.Header.Get("link") != "<?limit=100&offset=0>; rel=\"prev\"" {
+		t.Error("Unexpected last page", data, response.Header.Get("link"))
+	}
+	_ = rule.db.Close()
+
+	rule = newTestSQLiteRule(&DBConfig{Pagination: &DBPagination{Mode: "keyset", Key: "id", Start: "0", Limit: 3},
+		Queries: map[string]*DBQuery{"get": {Statement: "SELECT id, name FROM items WHERE id > :after ORDER BY id LIMIT :limit"}}})
+	defer func() {
+		_ = rule.db.Close()
+	}()
+	response, data = dbTripBody(t, rule, "sqlite:///:memory:/items", "")
+	if response.Header.Get("link") != "<?after=3&limit=3>; rel=\"next\"" {
+		t.Error("Unexpected keyset links", response.Header.Get("link"))
+	}
+	response, data = dbTripBody(t, rule, "sqlite:///:memory:/items?after=3", "application/x-ndjson")
+	if data != "{\"id\":4,\"name\":\"item, 4\"}\n{\"id\":5,\"name\":\"item, 5\"}\n" || response.Header.Get("link") != "" {
+		t.Error("Unexpected keyset page", data, response.Header.Get("link"))
+	}
+}
+
+func TestDBTrip_Timeout(t *testing.T) {
+	template = NewRPTemplate()
+	rule := newTestSQLiteRule(&DBConfig{Timeout: "1ns", Queries: map[string]*DBQuery{"get": {Statement: "SELECT * FROM items"}}})
+	defer func() {
+		_ = rule.db.Close()
+	}()
+	if rule.Database.GetTimeout() != time.Nanosecond {
+		t.Error("Database timeout not parsed")
+	}
+	request, _ := http.NewRequest("GET", "sqlite:///:memory:/items", nil)
+	wrapper := APIWrapper{Rule: rule, Request: NewAPIRequest(request), Context: context.Background()}
+	if response, err := DBTrip(request, &wrapper); err == nil {
+		if _, err = io.ReadAll(response.Body); err == nil {
+			t.Error("Queries exceeding the timeout should fail")
+		}
+	}
+}
+
+func TestDBConfig_Open(t *testing.T) {
+	cfg := DBConfig{Pool: &DBPoolConfig{MaxOpen: 4, MaxIdle: 1, MaxLifetime: "1h", MaxIdleTime: "5m"}}
+	db, err := cfg.Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal("Could not open the database", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if err = cfg.Ping(db); err != nil {
+		t.Error("Could not reach the database", err)
+	}
+	if db.Stats().MaxOpenConnections != 4 {
+		t.Error("Pool not configured")
+	}
+	cfg.Pool.MaxLifetime = "forever"
+	if _, err = cfg.Open("sqlite", ":memory:"); err == nil {
+		t.Error("Invalid pool configurations should not be accepted")
+	}
+	memoryDB, _ := (&DBConfig{}).Open("sqlite", ":memory:")
+	if memoryDB.Stats().MaxOpenConnections != 1 {
+		t.Error("In-memory databases should have one connection")
+	}
+	_ = memoryDB.Close()
+}
+
+func TestDBTrip_ReadOnly(t *testing.T) {
+	template = NewRPTemplate()
+	rule := newTestSQLiteRule(&DBConfig{ReadOnly: true, Queries: map[string]*DBQuery{"get": {Statement: "SELECT id FROM items WHERE id = 1"}}})
+	defer func() {
+		_ = rule.db.Close()
+	}()
+	_, data := dbTripBody(t, rule, "sqlite:///:memory:/items", "")
+	if data != "[{\"id\":1}]" {
+		t.Error("Unexpected read-only response", data)
+	}
+	rule.Database.Rest = &DBRestConfig{Tables: map[string]*DBRestTable{"items": {Columns: []string{"id", "name"}}}}
+	_ = rule.Database.Init()
+	request, _ := http.NewRequest("DELETE", "sqlite:///:memory:/items/1", nil)
+	wrapper := APIWrapper{Rule: rule, Request: NewAPIRequest(request), Context: context.Background()}
+	wrapper.Request.UrlVars = map[string]string{"table": "items", "id": "1"}
+	if response, _ := DBTrip(request, &wrapper); response.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("REST resources should not be writable in read-only mode")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestExecRule writes a shell script and returns a rule running it
+func newTestExecRule(t *testing.T, script string, cfg *ExecConfig) *Rule {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rule := Rule{Origin: "exec://" + path, StripPrefix: "/report", Exec: cfg}
+	if err := rule.Exec.Init(rule.Origin); err != nil {
+		t.Fatal("Could not initialize the exec origin", err)
+	}
+	return &rule
+}
+
+// execTestTrip runs the exec origin of the rule
+func execTestTrip(t *testing.T, rule *Rule, path string, body string) (*http.Response, string) {
+	request, _ := http.NewRequest("POST", rule.Origin+path, strings.NewReader(body))
+	request.Header.Set("x-foo", "bar")
+	request.Header.Set("Authorization", "Bearer secret")
+	wrapper := APIWrapper{Rule: rule, Request: NewAPIRequest(request), Context: context.Background()}
+	response, err := ExecTrip(request, &wrapper)
+	if err != nil {
+		t.Fatal("Exec request failed", err)
+	}
+	data, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	return response, string(data)
+}
+
+func TestExecTrip(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	script := "echo 'Content-Type: text/plain'\necho 'Status: 201 Created'\necho\n" +
+		"echo \"$1 $REQUEST_METHOD $PATH_INFO $QUERY_STRING $HTTP_X_FOO $CONTENT_LENGTH\"\ncat\n"
+	rule := newTestExecRule(t, script, &ExecConfig{Args: []string{"${Request.GetQuery(format)}"}, AllowedArgs: []string{"json|csv"}})
+	response, body := execTestTrip(t, rule, "/foo?format=csv", "hello")
+	if response.StatusCode != 201 || response.Header.Get("content-type") != "text/plain" || response.Header.Get("status") != "" {
+		t.Error("Unexpected exec response", response.StatusCode, response.Header)
+	}
+	if body != "csv POST /foo format=csv bar 5\nhello" {
+		t.Error("Unexpected exec body", body)
+	}
+	if response, _ = execTestTrip(t, rule, "?format=xml", ""); response.StatusCode != 400 {
+		t.Error("Arguments not in the allowlist should be rejected", response.StatusCode)
+	}
+	if err := (&ExecConfig{Args: []string{"${Request.Method}"}}).Init(rule.Origin); err == nil {
+		t.Error("Templated arguments should require an allowlist")
+	}
+
+	script = "echo\necho \"$HTTP_AUTHORIZATION\"\n"
+	if _, body = execTestTrip(t, newTestExecRule(t, script, &ExecConfig{}), "", ""); body != "\n" {
+		t.Error("The Authorization header should be withheld", body)
+	}
+	if _, body = execTestTrip(t, newTestExecRule(t, script, &ExecConfig{PassAuthorization: true}), "", ""); body != "Bearer secret\n" {
+		t.Error("The Authorization header should be passed when enabled", body)
+	}
+
+	rule = newTestExecRule(t, "exit 1\n", &ExecConfig{})
+	if response, _ = execTestTrip(t, rule, "", ""); response.StatusCode != 502 {
+		t.Error("Executables without headers should return a 502", response.StatusCode)
+	}
+	rule = newTestExecRule(t, "sleep 5\n", &ExecConfig{Timeout: "100ms"})
+	if response, _ = execTestTrip(t, rule, "", ""); response.StatusCode != 504 {
+		t.Error("Slow executables should time out", response.StatusCode)
+	}
+}
+
+func TestExecTrip_MaxConcurrency(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	rule := newTestExecRule(t, "echo\necho started\nsleep 5\n", &ExecConfig{MaxConcurrency: 1})
+	request, _ := http.NewRequest("GET", rule.Origin, nil)
+	wrapper := APIWrapper{Rule: rule, Request: NewAPIRequest(request), Context: context.Background()}
+	running, err := ExecTrip(request, &wrapper)
+	if err != nil || running.StatusCode != 200 {
+		t.Fatal("Exec request failed", err)
+	}
+	if response, _ := ExecTrip(request, &wrapper); response.StatusCode != 503 {
+		t.Error("Executions over the concurrency cap should be rejected", response.StatusCode)
+	}
+	// closing the body terminates the execution and frees the slot
+	_ = running.Body.Close()
+	if response, _ := ExecTrip(request, &wrapper); response.StatusCode != 200 {
+		t.Error("The slot should have been freed", response.StatusCode)
+	} else {
+		_ = response.Body.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startTestFCGI starts a FastCGI application echoing the parameters and the body, on the given network
+func startTestFCGI(t *testing.T, network string, address string) string {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		_ = fcgi.Serve(listener, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			env := fcgi.ProcessEnv(request)
+			body, _ := io.ReadAll(request.Body)
+			writer.Header().Set("x-script", env["SCRIPT_FILENAME"])
+			writer.Header().Set("x-document-uri", env["DOCUMENT_URI"])
+			if request.URL.Query().Get("missing") != "" {
+				writer.WriteHeader(404)
+			}
+			_, _ = writer.Write([]byte(request.Method + " " + request.URL.RequestURI() + " " + request.Header.Get("x-foo") + " " + string(body)))
+		}))
+	}()
+	return listener.Addr().String()
+}
+
+func TestFCGITrip(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	call := func(rule *Rule, target string, body string) (*http.Response, string) {
+		request, _ := http.NewRequest("POST", target, strings.NewReader(body))
+		request.Header.Set("x-foo", "bar")
+		wrapper := APIWrapper{Rule: rule, Request: NewAPIRequest(request), Context: context.Background()}
+		response, err := FCGITrip(request, &wrapper)
+		if err != nil {
+			t.Fatal("FastCGI request failed", err)
+		}
+		data, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		return response, string(data)
+	}
+
+	address := startTestFCGI(t, "tcp", "127.0.0.1:0")
+	rule := Rule{Origin: "fcgi://" + address, FCGI: &FCGIConfig{DocumentRoot: "/var/www"}}
+	if err := rule.FCGI.Init(rule.Origin); err != nil {
+		t.Fatal("Could not initialize the FastCGI origin", err)
+	}
+	response, body := call(&rule, "fcgi://"+address+"/app/?x=1", strings.Repeat("a", 70000))
+	if response.StatusCode != 200 || response.Header.Get("x-script") != "/var/www/app/index.php" {
+		t.Error("Unexpected FastCGI response", response.StatusCode, response.Header)
+	}
+	if body != "POST /app/?x=1 bar "+strings.Repeat("a", 70000) {
+		t.Error("Unexpected FastCGI body", len(body))
+	}
+	if response, _ = call(&rule, "fcgi://"+address+"/foo.php?missing=1", ""); response.StatusCode != 404 {
+		t.Error("FastCGI status not forwarded", response.StatusCode)
+	}
+
+	socket := filepath.Join(t.TempDir(), "fcgi.sock")
+	startTestFCGI(t, "unix", socket)
+	rule = Rule{Origin: "fcgi+unix://" + socket, FCGI: &FCGIConfig{DocumentRoot: "/var/www", Script: "public/index.php"}}
+	if err := rule.FCGI.Init(rule.Origin); err != nil {
+		t.Fatal("Could not initialize the FastCGI origin", err)
+	}
+	response, body = call(&rule, "fcgi+unix://"+socket+"/users/1", "")
+	if response.Header.Get("x-script") != "/var/www/public/index.php" || response.Header.Get("x-document-uri") != "/users/1" ||
+		body != "POST /users/1 bar " {
+		t.Error("Unexpected FastCGI front controller response", response.Header, body)
+	}
+
+	if (&FCGIConfig{}).Init("fcgi://127.0.0.1:1") == nil {
+		t.Error("FastCGI origins should require a document root")
+	}
+	rule = Rule{Origin: "fcgi://127.0.0.1:1", FCGI: &FCGIConfig{DocumentRoot: "/var/www"}}
+	_ = rule.FCGI.Init(rule.Origin)
+	if response, _ = call(&rule, "fcgi://127.0.0.1:1/", ""); response.StatusCode != 502 {
+		t.Error("Unreachable FastCGI applications should return a 502", response.StatusCode)
+	}
+}
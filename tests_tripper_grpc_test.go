@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGreeterDescriptor describes a test.Greeter service with a SayHello(HelloRequest) returns (HelloReply) method
+func testGreeterDescriptor() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, fieldType descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), JsonName: proto.String(name), Number: proto.Int32(number),
+			Type: fieldType.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+	}
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("greeter.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("HelloRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("times", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+				field("polite", 3, descriptorpb.FieldDescriptorProto_TYPE_BOOL)}},
+			{Name: proto.String("HelloReply"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("message", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING)}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("SayHello"),
+				InputType: proto.String(".test.HelloRequest"), OutputType: proto.String(".test.HelloReply")}}}},
+	}
+}
+
+// startTestGreeter starts a gRPC server implementing test.Greeter with dynamic messages
+func startTestGreeter(t *testing.T) string {
+	file, err := protodesc.NewFile(testGreeterDescriptor(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestDesc := file.Messages().ByName("HelloRequest")
+	replyDesc := file.Messages().ByName("HelloReply")
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{ServiceName: "test.Greeter", HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{MethodName: "SayHello",
+			Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				in := dynamicpb.NewMessage(requestDesc)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				name := in.Get(requestDesc.Fields().ByName("name")).String()
+				if name == "" {
+					return nil, status.Error(codes.NotFound, "nobody to greet")
+				}
+				md, _ := metadata.FromIncomingContext(ctx)
+				_ = grpc.SetHeader(ctx, metadata.Pairs("x-auth", strings.Join(md.Get("authorization"), "")))
+				greeting := "hello"
+				if in.Get(requestDesc.Fields().ByName("polite")).Bool() {
+					greeting = "good morning"
+				}
+				times := int(in.Get(requestDesc.Fields().ByName("times")).Int())
+				out := dynamicpb.NewMessage(replyDesc)
+				out.Set(replyDesc.Fields().ByName("message"), protoreflect.ValueOfString(strings.Repeat(greeting+" "+name+" ", times)))
+				return out, nil
+			}}}}, struct{}{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestGRPCTrip(t *testing.T) {
+	address := startTestGreeter(t)
+	data, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testGreeterDescriptor()}})
+	descriptorPath := filepath.Join(t.TempDir(), "greeter.pb")
+	_ = os.WriteFile(descriptorPath, data, 0644)
+
+	if (&GRPCConfig{DescriptorSet: descriptorPath, Methods: map[string]string{"post": "test.Greeter/SayGoodbye"}}).Init("grpc://"+address) == nil {
+		t.Error("Unknown gRPC methods should not be accepted")
+	}
+	rule := Rule{Origin: "grpc://" + address, GRPC: &GRPCConfig{DescriptorSet: descriptorPath,
+		Methods: map[string]string{"post": "test.Greeter/SayHello"}}}
+	if err := rule.GRPC.Init(rule.Origin); err != nil {
+		t.Fatal("Could not initialize the gRPC origin", err)
+	}
+	call := func(method string, body string, vars map[string]string) (*http.Response, string) {
+		request, _ := http.NewRequest(method, "grpc://"+address+"/hello", strings.NewReader(body))
+		request.Header.Set("authorization", "Bearer foo")
+		wrapper := APIWrapper{Rule: &rule, Request: NewAPIRequest(request), Context: context.Background()}
+		wrapper.Request.UrlVars = vars
+		response, err := GRPCTrip(request, &wrapper)
+		if err != nil {
+			t.Fatal("gRPC request failed", err)
+		}
+		data, _ := io.ReadAll(response.Body)
+		return response, string(data)
+	}
+	response, body := call("POST", "{\"times\":2}", map[string]string{"name": "foo", "polite": "true"})
+	if response.StatusCode != 200 || body != "{\"message\":\"good morning foo good morning foo \"}" {
+		t.Error("Unexpected gRPC response", response.StatusCode, body)
+	}
+	if response.Header.Get("grpc-metadata-x-auth") != "Bearer foo" {
+		t.Error("Metadata not forwarded", response.Header)
+	}
+	response, body = call("POST", "{}", nil)
+	if response.StatusCode != 404 || body != "{\"code\":5,\"message\":\"nobody to greet\"}" {
+		t.Error("gRPC status not mapped", response.StatusCode, body)
+	}
+	if response, _ = call("POST", "{\"unknown\":1}", nil); response.StatusCode != 400 {
+		t.Error("Invalid messages should be rejected", response.StatusCode)
+	}
+	if response, _ = call("GET", "", nil); response.StatusCode != 405 {
+		t.Error("Unmapped methods should not be allowed", response.StatusCode)
+	}
+}
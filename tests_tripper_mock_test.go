@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMockTrip(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	template = NewRPTemplate()
+	mock := MockConfig{Responses: []*MockResponse{
+		{When: MockCondition{Method: "post"}, Status: 201, Headers: StringMap{"X-Method": "${Request.Method}"},
+			Body: "created ${Request.UrlVars.id}"},
+		{When: MockCondition{UrlVars: StringMap{"id": "^[0-9]+$"}, Query: StringMap{"full": "^true$"}},
+			Template: "etc/templates/main.templ"},
+	}}
+	if err := mock.Init(); err != nil {
+		t.Fatal("Could not initialize mock config")
+	}
+	rule := Rule{Origin: "mock://", Mock: &mock}
+	ux, _ := url.Parse("mock:///users/1")
+	req := &http.Request{Method: "POST", URL: ux}
+	wrapper := APIWrapper{Request: NewAPIRequest(req), Rule: &rule, Context: context.Background()}
+	wrapper.Request.UrlVars = map[string]string{"id": "1"}
+	res, _ := MockTrip(req, &wrapper)
+	data, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 201 || string(data) != "created 1" || res.Header.Get("X-Method") != "POST" {
+		t.Error("Mock tripper did not render the expected variant")
+	}
+
+	req.Method = "GET"
+	res, _ = MockTrip(req, &wrapper)
+	if res.StatusCode != 404 {
+		t.Error("Mock tripper should return 404 when no variant matches")
+	}
+
+	req.URL, _ = url.Parse("mock:///users/1?full=true")
+	res, _ = MockTrip(req, &wrapper)
+	data, _ = io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(data) != "{\n  \"foo\":\"bar\",\n  \"method\": \"GET\"\n}" {
+		t.Error("Mock tripper did not render the template variant")
+	}
+}
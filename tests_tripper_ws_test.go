@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestWSEcho starts a websocket server echoing every message, and returns its URL
+func startTestWSEcho(t *testing.T) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// startTestWSProxy starts a server proxying the websocket connections to the origin with the provided rule, and
+// returns a client connection to it
+func startTestWSProxy(t *testing.T, origin string, rule *Rule) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request = ReqWithContext(request, writer, rule)
+		wrapper := GetWrapper(request)
+		wrapper.Request = NewAPIRequest(request)
+		request.URL, _ = url.Parse(origin)
+		_, _ = WSTripper(request, rule)
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("Could not connect to the websocket proxy", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestWSTripper_Pipeline(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	config = LoadConfig("etc/config.yaml")
+	origin := startTestWSEcho(t)
+	rule := Rule{Origin: origin, WebSocket: &WSConfig{
+		Inbound: WSPipelineConfig{Transformers: []TransformerConfig{
+			{Id: "barrage", Params: AnyMap{"bodyRegexp": "forbidden"}},
+			{Id: "scriptable", Params: AnyMap{"script": "message.data = message.data.toUpperCase(); true"}},
+		}},
+		Outbound: WSPipelineConfig{Transformers: []TransformerConfig{
+			{Id: "rate-limiter", Params: AnyMap{"limit": 2, "range": "1m"}},
+		}, Sidecars: []SidecarConfig{{Id: "access-log"}}},
+	}}
+	if err := rule.WebSocket.Init(); err != nil {
+		t.Fatal("Could not initialize the websocket pipelines", err)
+	}
+	conn := startTestWSProxy(t, origin, &rule)
+	for _, message := range []string{"hello", "forbidden", "world", "again"} {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(message))
+	}
+	received := make([]string, 0)
+	_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		received = append(received, string(data))
+	}
+	if strings.Join(received, ",") != "HELLO,WORLD" {
+		t.Error("Unexpected messages through the pipeline", received)
+	}
+}
+
+func TestWSTripper_CloseOnReject(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	config = LoadConfig("etc/config.yaml")
+	origin := startTestWSEcho(t)
+	rule := Rule{Origin: origin, WebSocket: &WSConfig{CloseOnReject: true,
+		Inbound: WSPipelineConfig{MaxMessageSize: 10, Transformers: []TransformerConfig{
+			{Id: "scriptable", Params: AnyMap{"script": "message.data != 'bye'"}},
+		}},
+	}}
+	if err := rule.WebSocket.Init(); err != nil {
+		t.Fatal("Could not initialize the websocket pipelines", err)
+	}
+	conn := startTestWSProxy(t, origin, &rule)
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("bye"))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Error("Rejected messages should close the connection", err)
+	}
+
+	conn = startTestWSProxy(t, origin, &rule)
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("this message is too long"))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("Large messages should close the connection", err)
+	}
+}
+
+func TestNewWSTransformers(t *testing.T) {
+	log = NewLogHelper("", logrus.InfoLevel)
+	if _, err := NewWSTransformers([]TransformerConfig{{Id: "foo"}}); err == nil {
+		t.Error("Unknown websocket transformers should not be accepted")
+	}
+	if _, err := NewWSTransformers([]TransformerConfig{{Id: "rate-limiter", Params: AnyMap{"limit": 1}}}); err == nil {
+		t.Error("Rate limiters without a range should not be accepted")
+	}
+}
@@ -22,6 +22,22 @@ func TestAPIWrapper_Clone(t *testing.T) {
 	}
 }
 
+func TestAPIWrapper_CloneContext(t *testing.T) {
+	rule := Rule{Origin: "foobar", _timeout: 50 * time.Millisecond}
+	wrapper := GetWrapper(ReqWithContext(&http.Request{Method: "GET"}, nil, &rule))
+	wrapper.Request = NewAPIRequest(&http.Request{Method: "GET"})
+	clone := wrapper.Clone()
+	defer clone.Release()
+	wrapper.Release()
+	if clone.Context.Err() != nil {
+		t.Error("Clones should outlive the transaction", clone.Context.Err())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !clone.TimedOut() {
+		t.Error("Clones should have a deadline of their own")
+	}
+}
+
 func TestAPIWrapper_ExpandRequest(t *testing.T) {
 	wrapper := APIWrapper{Request: NewAPIRequest(&http.Request{Method: "GET"}),
 		Response: NewAPIResponse(&http.Response{StatusCode: 200})}
@@ -34,6 +50,22 @@ func TestAPIWrapper_ExpandRequest(t *testing.T) {
 	if string(wrapper.Request.ExpandedBody) != "foo" {
 		t.Error("Request expansion failed")
 	}
+	wrapper.Request.Body = io.NopCloser(bytes.NewReader([]byte("bar")))
+	wrapper.ExpandRequest()
+	if string(wrapper.Request.ExpandedBody) != "foo" {
+		t.Error("Request expanded twice")
+	}
+	wrapper.Request.ExpandedBody = nil
+	wrapper.Rule = &Rule{MaxExpandSize: 2}
+	wrapper.Request.Body = io.NopCloser(bytes.NewReader([]byte("foo")))
+	wrapper.ExpandRequest()
+	wrapper.ExpandRequest()
+	if len(wrapper.Tags) != 1 || wrapper.Tags[0] != "request_not_expanded" {
+		t.Error("Request not expanded tag should be added once", wrapper.Tags)
+	}
+	if data, _ := io.ReadAll(wrapper.Request.Body); string(data) != "foo" {
+		t.Error("Request body not left untouched", string(data))
+	}
 }
 
 func TestAPIWrapper_ExpandResponse(t *testing.T) {
@@ -80,6 +112,25 @@ func TestReqWithContext(t *testing.T) {
 	}
 }
 
+func TestAPIWrapper_LiftDeadline(t *testing.T) {
+	rule := Rule{Origin: "foobar", _timeout: 50 * time.Millisecond}
+	expiring := GetWrapper(ReqWithContext(&http.Request{Method: "GET"}, nil, &rule))
+	lifted := GetWrapper(ReqWithContext(&http.Request{Method: "GET"}, nil, &rule))
+	lifted.LiftDeadline()
+	time.Sleep(100 * time.Millisecond)
+	if !expiring.TimedOut() {
+		t.Error("Transaction deadline not honored")
+	}
+	if lifted.TimedOut() || lifted.Context.Err() != nil {
+		t.Error("Lifted deadlines should not expire")
+	}
+	lifted.Release()
+	if lifted.TimedOut() || lifted.Context.Err() == nil {
+		t.Error("Released transactions should be cancelled, not timed out")
+	}
+	expiring.Release()
+}
+
 func TestAPIMetrics_Measurements(t *testing.T) {
 	req := &http.Request{Method: "GET"}
 	rule := Rule{Origin: "foobar"}
@@ -97,3 +148,33 @@ func TestAPIMetrics_Measurements(t *testing.T) {
 		t.Error("Metrics monitoring is not working according to plan")
 	}
 }
+
+func TestAPIWrapper_ExpandRequestMaxExpandSize(t *testing.T) {
+	wrapper := APIWrapper{Request: NewAPIRequest(&http.Request{Method: "POST"}), Rule: &Rule{MaxExpandSize: 3},
+		Tags: []string{}}
+	wrapper.Request.Body = io.NopCloser(bytes.NewReader([]byte("foobar")))
+	_ = wrapper.ExpandRequest()
+	if len(wrapper.Request.ExpandedBody) > 0 || !wrapper.HasTag([]string{"request_not_expanded"}) {
+		t.Error("Request larger than the max expand size should not be expanded")
+	}
+	data, _ := io.ReadAll(wrapper.Request.Body)
+	if string(data) != "foobar" {
+		t.Error("Request body not preserved when expansion is skipped")
+	}
+}
+
+func TestAPIWrapper_LimitRequestBody(t *testing.T) {
+	wrapper := APIWrapper{Request: NewAPIRequest(&http.Request{Method: "POST", ContentLength: 6}),
+		Rule: &Rule{MaxBodySize: 3}}
+	wrapper.Request.Body = io.NopCloser(bytes.NewReader([]byte("foobar")))
+	if err := wrapper.LimitRequestBody(); err == nil || err.Error() != "body_too_large" {
+		t.Error("Declared content length exceeding the limit not rejected")
+	}
+	wrapper.Request.ContentLength = -1
+	if err := wrapper.LimitRequestBody(); err != nil {
+		t.Error("Undeclared content length should not be rejected upfront")
+	}
+	if err := wrapper.ExpandRequest(); err == nil || err.Error() != "body_too_large" {
+		t.Error("Body exceeding the limit not detected while expanding")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"net/url"
+	"regexp"
+)
+
+// SplitConfig is the configuration of the traffic split of a rule. It allows a portion of the traffic to be routed
+// to alternate origins
+// Primary is the name of the variant represented by the rule origin. Defaults to "primary"
+// Sticky is a template whose evaluation determines the assignment to a weighted variant. If it's empty, or evaluates
+// to an empty string, the assignment is random
+// Variants is the list of alternate origins
+type SplitConfig struct {
+	Primary  string          `yaml:"primary"`
+	Sticky   string          `yaml:"sticky"`
+	Variants []*SplitVariant `yaml:"variants"`
+}
+
+// SplitVariant is an alternate origin for a rule
+// Name is the name of the variant. It will be applied as a tag to the transactions it serves
+// Origin is the alternate origin URL
+// Weight is the percentage (0-100) of the traffic to route to this variant
+// Headers is a map of header name=regexp. If all of them match, the variant is chosen
+// Cookies is a map of cookie name=regexp. If all of them match, the variant is chosen
+// Tags is a list of tags. If the transaction has any of them, the variant is chosen
+// _origin is the parsed version of Origin
+// _headers is the compiled version of Headers
+// _cookies is the compiled version of Cookies
+type SplitVariant struct {
+	Name     string    `yaml:"name"`
+	Origin   string    `yaml:"origin"`
+	Weight   float64   `yaml:"weight"`
+	Headers  StringMap `yaml:"headers"`
+	Cookies  StringMap `yaml:"cookies"`
+	Tags     []string  `yaml:"tags"`
+	_origin  *url.URL
+	_headers map[string]*regexp.Regexp
+	_cookies map[string]*regexp.Regexp
+}
+
+// Init will evaluate the origins and compile the regular expressions
+func (s *SplitConfig) Init() error {
+	if s.Primary == "" {
+		s.Primary = "primary"
+	}
+	for _, variant := range s.Variants {
+		origin, err := template.Templ(context.Background(), variant.Origin, nil)
+		if err != nil {
+			return err
+		}
+		variant._origin, err = url.Parse(origin)
+		if err != nil {
+			return err
+		}
+		variant._headers, err = compileRegexpMap(variant.Headers)
+		if err != nil {
+			return err
+		}
+		variant._cookies, err = compileRegexpMap(variant.Cookies)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select will choose the variant for the provided transaction. Variants with conditions are evaluated first, in
+// order, and the first whose conditions match wins. Otherwise, the variant is chosen by weight among the ones with no
+// conditions. If no variant is chosen, nil is returned, meaning the rule origin should be used
+func (s *SplitConfig) Select(wrapper *APIWrapper) *SplitVariant {
+	for _, variant := range s.Variants {
+		if variant.hasConditions() && variant.matches(wrapper) {
+			return variant
+		}
+	}
+	bucket := s.bucket(wrapper)
+	var cumulative float64
+	for _, variant := range s.Variants {
+		if !variant.hasConditions() && variant.Weight > 0 {
+			cumulative += variant.Weight
+			if bucket < cumulative {
+				return variant
+			}
+		}
+	}
+	return nil
+}
+
+// bucket returns a number in the [0,100) range. If Sticky is set, the number is derived from the hash of its
+// evaluation, so that the same evaluation always lands in the same bucket. Otherwise, it's random
+func (s *SplitConfig) bucket(wrapper *APIWrapper) float64 {
+	if s.Sticky != "" {
+		if key, err := wrapper.Templ(wrapper.Context, s.Sticky); err == nil && key != "" {
+			hash := fnv.New32a()
+			_, _ = hash.Write([]byte(key))
+			return float64(hash.Sum32()%10000) / 100
+		}
+	}
+	return rand.Float64() * 100
+}
+
+// hasConditions returns true if the variant is chosen by conditions rather than by weight
+func (v *SplitVariant) hasConditions() bool {
+	return len(v._headers) > 0 || len(v._cookies) > 0 || len(v.Tags) > 0
+}
+
+// matches returns true if the provided transaction matches all the conditions of the variant
+func (v *SplitVariant) matches(wrapper *APIWrapper) bool {
+	for name, rx := range v._headers {
+		if !rx.MatchString(wrapper.Request.Header.Get(name)) {
+			return false
+		}
+	}
+	for name, rx := range v._cookies {
+		cookie, err := wrapper.Request.Cookie(name)
+		if err != nil || !rx.MatchString(cookie.Value) {
+			return false
+		}
+	}
+	if len(v.Tags) > 0 && !wrapper.HasTag(v.Tags) {
+		return false
+	}
+	return true
+}
+
+// compileRegexpMap compiles a map of name=regexp
+func compileRegexpMap(data StringMap) (map[string]*regexp.Regexp, error) {
+	res := make(map[string]*regexp.Regexp)
+	for k, v := range data {
+		rx, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		res[k] = rx
+	}
+	return res, nil
+}
@@ -89,6 +89,8 @@ func NewRequestTransformers(transformers *[]TransformerConfig) (*RequestTransfor
 			transformer, err = NewCookieToTokenTransformer(t.ActivateOnTags, t.Logging, t.Params)
 		case "scriptable":
 			transformer, err = NewScriptableTransformer(t.ActivateOnTags, t.Logging, t.Params)
+		case "wasm":
+			transformer, err = NewWasmTransformer(t.ActivateOnTags, t.Logging, t.Params)
 		case "delay":
 			transformer, err = NewDelayTransformer(t.ActivateOnTags, t.Logging, t.Params)
 		case "barrage":
@@ -103,6 +105,8 @@ func NewRequestTransformers(transformers *[]TransformerConfig) (*RequestTransfor
 			transformer, err = NewRequestOpenAPIValidatorTransformer(t.ActivateOnTags, t.Logging)
 		case "payload":
 			transformer, err = NewRequestPayloadTransformer(t.ActivateOnTags, t.Logging, t.Params)
+		case "graphql":
+			transformer, err = NewGraphQLTransformer(t.ActivateOnTags, t.Logging, t.Params)
 		}
 		if transformer != nil && err == nil {
 			res.Push(transformer)
@@ -201,6 +205,8 @@ func NewResponseTransformers(transformers *[]TransformerConfig) (*ResponseTransf
 			transformer, err = NewResponseHeadersTransformerFromParams(t.ActivateOnTags, t.Logging, t.Params)
 		case "scriptable":
 			transformer, err = NewScriptableTransformer(t.ActivateOnTags, t.Logging, t.Params)
+		case "wasm":
+			transformer, err = NewWasmTransformer(t.ActivateOnTags, t.Logging, t.Params)
 		case "delay":
 			transformer, _ = NewDelayTransformer(t.ActivateOnTags, t.Logging, t.Params)
 		case "barrage":
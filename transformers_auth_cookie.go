@@ -43,7 +43,7 @@ func (t *RequestCookieToTokenTransformer) Transform(wrapper *APIWrapper) (*APIWr
 	if err != nil {
 		return nil, errors.New("no_auth")
 	}
-	cmd := t.redisClient.Get(context.Background(), cookie.Value)
+	cmd := t.redisClient.Get(wrapper.GetContext(), cookie.Value)
 	if cmd.Err() != nil {
 		if cmd.Err() == redis.Nil {
 			t.log.Log("no auth", wrapper, t.log.Debug)
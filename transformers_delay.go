@@ -44,8 +44,13 @@ func (t *DelayTransformer) Transform(wrapper *APIWrapper) (*APIWrapper, error) {
 	timeRange := t._max.Nanoseconds() - t._min.Nanoseconds()
 	nanos := t._min.Nanoseconds() + rand.Int63n(timeRange)
 	t.log.Log("delaying request by "+fmt.Sprintf("%d", nanos/1000)+"ms", wrapper, t.log.Debug)
-	time.Sleep(time.Duration(nanos))
-	return wrapper, nil
+	// the delay is interrupted if the transaction deadline is exceeded in the meantime
+	select {
+	case <-time.After(time.Duration(nanos)):
+		return wrapper, nil
+	case <-wrapper.GetContext().Done():
+		return wrapper, wrapper.GetContext().Err()
+	}
 }
 
 func (t *DelayTransformer) ErrorMatches(_ error) bool {
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GraphQLTransformer parses the GraphQL operation in the request, enforces its limits and tags the transaction with
+// the operation type and name
+// MaxDepth is the maximum depth of the selected fields. Zero means no limit
+// MaxComplexity is the maximum complexity of the operation. Each field costs 1, plus the complexity of its
+// selection, multiplied by the value of its first, last or limit argument, if any. Zero means no limit
+// Allowlist is the path to a JSON file, mapping the SHA-256 hashes of the allowed queries to the queries. If set, any
+// other query is rejected, and clients can send the hash instead of the query, as in persisted queries
+// ActivateOnTags is a list of tags for which this plugin will activate. Leave empty for "always"
+// _allowlist is the loaded version of Allowlist
+type GraphQLTransformer struct {
+	MaxDepth       int
+	MaxComplexity  int
+	Allowlist      string
+	ActivateOnTags []string
+	_allowlist     map[string]string
+	log            *STLogHelper
+}
+
+// graphQLRequest is a GraphQL request, as sent by clients
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+	Extensions    struct {
+		PersistedQuery *struct {
+			Sha256Hash string `json:"sha256Hash"`
+		} `json:"persistedQuery"`
+	} `json:"extensions"`
+}
+
+// graphQLMultiplierArgs are the arguments multiplying the complexity of the selection of a field
+var graphQLMultiplierArgs = []string{"first", "last", "limit"}
+
+// graphQLMaxMultiplier caps the value of the multiplier arguments
+const graphQLMaxMultiplier = 1000
+
+// the errors of the operations exceeding the limits
+var (
+	errGraphQLTooDeep    = errors.New("GraphQL operation too deep")
+	errGraphQLTooComplex = errors.New("GraphQL operation too complex")
+)
+
+// NewGraphQLTransformer is the constructor for GraphQLTransformer
+func NewGraphQLTransformer(activateOnTags []string, logCfg *STLogConfig, params map[string]any) (*GraphQLTransformer, error) {
+	t := GraphQLTransformer{ActivateOnTags: activateOnTags, log: NewSTLogHelper(logCfg)}
+	err := template.DecodeAndTempl(context.Background(), params, &t, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if t.Allowlist != "" {
+		data, err := os.ReadFile(t.Allowlist)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &t._allowlist); err != nil {
+			return nil, err
+		}
+		for hash, query := range t._allowlist {
+			if hashGraphQLQuery(query) != strings.ToLower(hash) {
+				return nil, errors.New("the hash of an allowlisted GraphQL query does not match: " + hash)
+			}
+		}
+	}
+	t.log.PrometheusRegisterCounter("graphql_rejected")
+	return &t, nil
+}
+
+// Transform parses the operation, enforces the limits and tags the transaction
+func (t *GraphQLTransformer) Transform(wrapper *APIWrapper) (*APIWrapper, error) {
+	t.log.Log("triggering graphql transformer", wrapper, t.log.Debug)
+	gqlRequest, err := readGraphQLRequest(wrapper.Request)
+	if err != nil {
+		return t.reject(wrapper, "invalid GraphQL request", err, "bad_request")
+	}
+	if t._allowlist != nil {
+		if gqlRequest.Query == "" && gqlRequest.Extensions.PersistedQuery != nil {
+			// the client sent the hash of a persisted query, so we send the query to the origin
+			query, ok := t._allowlist[strings.ToLower(gqlRequest.Extensions.PersistedQuery.Sha256Hash)]
+			if !ok {
+				return t.reject(wrapper, "unknown persisted GraphQL query", nil, "graphql_not_allowed")
+			}
+			gqlRequest.Query = query
+			if err = writeGraphQLQuery(wrapper.Request, query); err != nil {
+				return wrapper, err
+			}
+		} else if _, ok := t._allowlist[hashGraphQLQuery(gqlRequest.Query)]; !ok {
+			return t.reject(wrapper, "GraphQL query not in the allowlist", nil, "graphql_not_allowed")
+		}
+	}
+	document, parseErr := parser.ParseQuery(&ast.Source{Input: gqlRequest.Query})
+	if parseErr != nil {
+		return t.reject(wrapper, "invalid GraphQL query", parseErr, "bad_request")
+	}
+	operation, err := selectGraphQLOperation(document, gqlRequest.OperationName)
+	if err != nil {
+		return t.reject(wrapper, "invalid GraphQL operation", err, "bad_request")
+	}
+	analyzer := graphQLAnalyzer{document: document, variables: gqlRequest.Variables, maxDepth: t.MaxDepth,
+		maxComplexity: t.MaxComplexity, visiting: map[string]bool{}, fragments: map[string]graphQLMeasure{}}
+	if _, _, err = analyzer.selectionSet(operation.SelectionSet); err != nil {
+		if err == errGraphQLTooDeep || err == errGraphQLTooComplex {
+			return t.reject(wrapper, err.Error(), nil, "bad_request")
+		}
+		return t.reject(wrapper, "invalid GraphQL operation", err, "bad_request")
+	}
+	wrapper.Tags = append(wrapper.Tags, "graphql-type:"+string(operation.Operation))
+	if operation.Name != "" {
+		wrapper.Tags = append(wrapper.Tags, "graphql-op:"+operation.Name)
+	}
+	return wrapper, nil
+}
+
+// reject logs the rejection of an operation and returns the provided error
+func (t *GraphQLTransformer) reject(wrapper *APIWrapper, message string, err error, outcome string) (*APIWrapper, error) {
+	t.log.PrometheusCounterInc("graphql_rejected")
+	t.log.LogErr(message, err, wrapper, t.log.Warn)
+	return wrapper, errors.New(outcome)
+}
+
+func (t *GraphQLTransformer) ShouldExpandRequest() bool {
+	return true
+}
+
+func (t *GraphQLTransformer) ShouldExpandResponse() bool {
+	return false
+}
+
+func (t *GraphQLTransformer) ErrorMatches(err error) bool {
+	return err.Error() == "graphql_not_allowed"
+}
+
+func (t *GraphQLTransformer) HandleError(writer *http.ResponseWriter) {
+	(*writer).WriteHeader(403)
+}
+
+func (t *GraphQLTransformer) IsActive(wrapper *APIWrapper) bool {
+	return wrapper.HasTag(t.ActivateOnTags)
+}
+
+// hashGraphQLQuery returns the hex encoded SHA-256 hash of a query
+func hashGraphQLQuery(query string) string {
+	hash := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(hash[:])
+}
+
+// readGraphQLRequest reads the GraphQL request from the query parameters, for GET requests, or from the body.
+// Bodies can either be JSON or application/graphql
+func readGraphQLRequest(request *APIRequest) (graphQLRequest, error) {
+	gqlRequest := graphQLRequest{}
+	if request.Method == http.MethodGet {
+		query := request.URL.Query()
+		gqlRequest.Query = query.Get("query")
+		gqlRequest.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &gqlRequest.Variables); err != nil {
+				return gqlRequest, err
+			}
+		}
+		if extensions := query.Get("extensions"); extensions != "" {
+			if err := json.Unmarshal([]byte(extensions), &gqlRequest.Extensions); err != nil {
+				return gqlRequest, err
+			}
+		}
+		return gqlRequest, nil
+	}
+	if strings.HasPrefix(request.Header.Get("content-type"), "application/graphql") {
+		gqlRequest.Query = string(request.ExpandedBody)
+		return gqlRequest, nil
+	}
+	err := json.Unmarshal(request.ExpandedBody, &gqlRequest)
+	return gqlRequest, err
+}
+
+// writeGraphQLQuery adds the query to the request, either in the query parameters or in the JSON body
+func writeGraphQLQuery(request *APIRequest, query string) error {
+	if request.Method == http.MethodGet {
+		values := request.URL.Query()
+		values.Set("query", query)
+		request.URL.RawQuery = values.Encode()
+		return nil
+	}
+	body := map[string]any{}
+	if err := json.Unmarshal(request.ExpandedBody, &body); err != nil {
+		return err
+	}
+	body["query"] = query
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request.ExpandedBody = data
+	request.Body = io.NopCloser(bytes.NewReader(data))
+	request.ContentLength = int64(len(data))
+	request.Header.Set("content-length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// selectGraphQLOperation selects the operation to execute. If the document has more than one operation, the operation
+// name is required
+func selectGraphQLOperation(document *ast.QueryDocument, operationName string) (*ast.OperationDefinition, error) {
+	if operationName != "" {
+		if operation := document.Operations.ForName(operationName); operation != nil {
+			return operation, nil
+		}
+		return nil, errors.New("operation not found: " + operationName)
+	}
+	if len(document.Operations) != 1 {
+		return nil, errors.New("the operation name is required when the document has more than one operation")
+	}
+	return document.Operations[0], nil
+}
+
+// graphQLAnalyzer measures the depth and the complexity of an operation, and stops as soon as they exceed the limits
+// visiting holds the fragments being visited, to detect cycles
+// fragments holds the measures of the fragments visited so far, so that each fragment is visited once
+type graphQLAnalyzer struct {
+	document      *ast.QueryDocument
+	variables     map[string]any
+	maxDepth      int
+	maxComplexity int
+	visiting      map[string]bool
+	fragments     map[string]graphQLMeasure
+}
+
+// graphQLMeasure is the depth and the complexity of a fragment
+type graphQLMeasure struct {
+	depth      int
+	complexity int
+}
+
+// selectionSet returns the depth and the complexity of a selection set. Fragments do not add depth. As the depth and
+// the complexity of a selection set can't be larger than the ones of the operation, the limits are enforced on the
+// way
+func (a *graphQLAnalyzer) selectionSet(set ast.SelectionSet) (int, int, error) {
+	maxDepth := 0
+	complexity := 0
+	for _, selection := range set {
+		var depth, cost int
+		var err error
+		switch s := selection.(type) {
+		case *ast.Field:
+			depth, cost, err = a.selectionSet(s.SelectionSet)
+			depth++
+			cost = saturatingAdd(1, saturatingMul(cost, a.multiplier(s.Arguments)))
+		case *ast.InlineFragment:
+			depth, cost, err = a.selectionSet(s.SelectionSet)
+		case *ast.FragmentSpread:
+			depth, cost, err = a.fragment(s.Name)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		complexity = saturatingAdd(complexity, cost)
+		if a.maxDepth > 0 && maxDepth > a.maxDepth {
+			return 0, 0, errGraphQLTooDeep
+		}
+		if a.maxComplexity > 0 && complexity > a.maxComplexity {
+			return 0, 0, errGraphQLTooComplex
+		}
+	}
+	return maxDepth, complexity, nil
+}
+
+// fragment returns the depth and the complexity of a fragment. They don't depend on where the fragment is spread, so
+// they're measured once
+func (a *graphQLAnalyzer) fragment(name string) (int, int, error) {
+	if measure, ok := a.fragments[name]; ok {
+		return measure.depth, measure.complexity, nil
+	}
+	fragment := a.document.Fragments.ForName(name)
+	if fragment == nil {
+		return 0, 0, errors.New("fragment not found: " + name)
+	}
+	if a.visiting[name] {
+		return 0, 0, errors.New("fragment cycle: " + name)
+	}
+	a.visiting[name] = true
+	depth, complexity, err := a.selectionSet(fragment.SelectionSet)
+	delete(a.visiting, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	a.fragments[name] = graphQLMeasure{depth: depth, complexity: complexity}
+	return depth, complexity, nil
+}
+
+// multiplier returns the value of the first multiplier argument of a field, or 1 if there's none. The value can
+// either be a literal or a variable, and is capped to graphQLMaxMultiplier
+func (a *graphQLAnalyzer) multiplier(arguments ast.ArgumentList) int {
+	for _, name := range graphQLMultiplierArgs {
+		argument := arguments.ForName(name)
+		if argument == nil || argument.Value == nil {
+			continue
+		}
+		var value float64
+		if argument.Value.Kind == ast.Variable {
+			value, _ = a.variables[argument.Value.Raw].(float64)
+		} else {
+			// values too large for a float are parsed as infinite
+			value, _ = strconv.ParseFloat(argument.Value.Raw, 64)
+		}
+		if value > graphQLMaxMultiplier {
+			return graphQLMaxMultiplier
+		}
+		if value > 1 {
+			return int(value)
+		}
+	}
+	return 1
+}
+
+// saturatingAdd adds two non-negative integers, stopping at the maximum integer instead of overflowing
+func saturatingAdd(a int, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
+// saturatingMul multiplies two non-negative integers, stopping at the maximum integer instead of overflowing
+func saturatingMul(a int, b int) int {
+	if b != 0 && a > math.MaxInt/b {
+		return math.MaxInt
+	}
+	return a * b
+}
@@ -6,10 +6,6 @@ import (
 	"github.com/theirish81/gowalker"
 	"io"
 	"net/http"
-	"os"
-	"path"
-	"path/filepath"
-	"strings"
 )
 
 // RequestPayloadTransformer is a transformer that will transform the request payload based on a set of templates
@@ -27,28 +23,8 @@ func NewRequestPayloadTransformer(activateOnTags []string, logCfg *STLogConfig,
 	if err != nil {
 		return &t, err
 	}
-	// reading the master template
-	data, err := os.ReadFile(t.Template)
-	if err != nil {
-		return &t, err
-	}
-	// loading the sub-templates, if any
-	templDir := path.Dir(t.Template)
-	t.subTemplates = gowalker.NewSubTemplates()
-	files, err := os.ReadDir(templDir)
-	if err != nil {
-		return &t, err
-	}
-	rootTemplateName := filepath.Base(t.Template)
-	t.Template = string(data)
-	for _, file := range files {
-		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") && file.Name() != rootTemplateName {
-			data, _ = os.ReadFile(path.Join(templDir, file.Name()))
-			subTemplateName := file.Name()[0:strings.LastIndex(file.Name(), ".")]
-			t.subTemplates[subTemplateName] = string(data)
-		}
-	}
-	return &t, nil
+	t.Template, t.subTemplates, err = loadTemplateWithSub(t.Template)
+	return &t, err
 }
 
 func (t *RequestPayloadTransformer) Transform(wrapper *APIWrapper) (*APIWrapper, error) {
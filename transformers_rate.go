@@ -52,12 +52,13 @@ func (t *RequestRateLimiterTransformer) Transform(wrapper *APIWrapper) (*APIWrap
 	// compiling the `vary` template in real time
 	vary, _ := template.Templ(wrapper.Context, t.Vary, wrapper)
 	// getting the length of the item retrieved with the value of `vary` as key
-	cmd := t.redisClient.LLen(context.Background(), vary)
+	cmd := t.redisClient.LLen(wrapper.GetContext(), vary)
 	// setting response header displaying the rate limit
 	wrapper.ApplyHeaders.Set("RateLimit-Limit", fmt.Sprintf("%d %d;window=%d", t.Limit, t.Limit, int(t._range.Seconds())))
 	if cmd.Err() != nil {
 		t.log.LogErr("error while reading length from redis", cmd.Err(), wrapper, t.log.Error)
-		return wrapper, nil
+		// if the transaction deadline has been exceeded, there's no point in moving forward
+		return wrapper, wrapper.GetContext().Err()
 	}
 	current := cmd.Val()
 	// if the retrieved count is greater than the configured limit
@@ -69,23 +70,23 @@ func (t *RequestRateLimiterTransformer) Transform(wrapper *APIWrapper) (*APIWrap
 	} else {
 		// if the retrieved count is less than the configured limit and
 		// the entry does not exist in Redis
-		if t.redisClient.Exists(context.Background(), vary).Val() == 0 {
+		if t.redisClient.Exists(wrapper.GetContext(), vary).Val() == 0 {
 			pipeline := t.redisClient.TxPipeline()
 			// we push the item
-			if err := pipeline.RPush(context.Background(), vary, vary).Err(); err != nil {
+			if err := pipeline.RPush(wrapper.GetContext(), vary, vary).Err(); err != nil {
 				t.log.LogErr("error while pushing to Redis in rate limiter", err, wrapper, t.log.Error)
 			}
 			// set the expiry time
-			if err := pipeline.Expire(context.Background(), vary, t._range).Err(); err != nil {
+			if err := pipeline.Expire(wrapper.GetContext(), vary, t._range).Err(); err != nil {
 				t.log.LogErr("error while setting Redis TTL in rate limiter", err, wrapper, t.log.Error)
 			}
 			// and execute the pipeline
-			if _, err := pipeline.Exec(context.Background()); err != nil {
+			if _, err := pipeline.Exec(wrapper.GetContext()); err != nil {
 				log.Error("error while setting running Redis pipeline in rate limiter", err, nil)
 			}
 		} else {
 			// if the entry already existed, then we just push a new item
-			t.redisClient.RPushX(context.Background(), vary, vary)
+			t.redisClient.RPushX(wrapper.GetContext(), vary, vary)
 		}
 	}
 	return wrapper, nil
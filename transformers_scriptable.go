@@ -3,16 +3,22 @@ package main
 import (
 	"context"
 	"errors"
-	"github.com/dop251/goja"
 	"net/http"
 	"os"
 )
 
 // ScriptableTransformer is a transformer that uses a JavaScript script
+// Script is the script
+// Path is the path to a file containing the script, as an alternative to Script
+// ScriptLimits are the limits of the executions of the script
+// ErrorStatus is the status code of the response when the script fails. Defaults to 500
+// _pool is the pool of runtimes running the compiled script
 type ScriptableTransformer struct {
 	Script         string
 	Path           string
-	_script        string
+	ScriptLimits   `mapstructure:",squash"`
+	ErrorStatus    int
+	_pool          *ScriptPool
 	ExpandRequest  bool
 	ExpandResponse bool
 	ActivateOnTags []string
@@ -20,27 +26,29 @@ type ScriptableTransformer struct {
 }
 
 // Transform will perform the transformation. The script must return true if the scripts wants the request to move
-// forward
+// forward, unless it responded on its own
 func (t *ScriptableTransformer) Transform(wrapper *APIWrapper) (*APIWrapper, error) {
-	runtime := goja.New()
-	err := runtime.Set("wrapper", wrapper)
-	if err != nil {
-		t.log.LogErr("error while creating setting wrapper in runtime", err, wrapper, t.log.Error)
-		return wrapper, err
-	}
-	// run the script
-	val, err := runtime.RunString(t._script)
-	// if the script failed at running, we return the error
+	api := scriptAPI{wrapper: wrapper, log: t.log}
+	// run the script. If the transaction deadline is exceeded while the script is running, the script is interrupted
+	val, err := t._pool.Run(wrapper.GetContext(), api.Globals())
+	// if the script failed at running, the transaction ends with the error status
 	if err != nil {
+		if wrapper.TimedOut() {
+			return wrapper, wrapper.Context.Err()
+		}
 		t.log.LogErr("error while running script", err, wrapper, t.log.Error)
-		return wrapper, err
+		return wrapper, t.failure()
+	}
+	// if the script produced a response, the transaction ends with it
+	if api.response != nil {
+		return wrapper, api.response
 	}
 	// export the result to a boolean
-	res, ok := val.Export().(bool)
-	// if the boolean conversion failed, then we return the error
+	res, ok := val.(bool)
+	// if the boolean conversion failed, then the script failed
 	if !ok {
 		t.log.LogErr("script did not return a boolean", nil, wrapper, t.log.Error)
-		return wrapper, errors.New("script did not return a boolean")
+		return wrapper, t.failure()
 	}
 	// if the script executed fine, and we got a boolean back, and the boolean is true, then we return positively
 	if res {
@@ -50,6 +58,11 @@ func (t *ScriptableTransformer) Transform(wrapper *APIWrapper) (*APIWrapper, err
 	return wrapper, errors.New("script_rejected")
 }
 
+// failure returns the response ending a transaction in which the script failed
+func (t *ScriptableTransformer) failure() *ScriptResponse {
+	return &ScriptResponse{Status: t.ErrorStatus, Headers: http.Header{}}
+}
+
 func (t *ScriptableTransformer) ErrorMatches(err error) bool {
 	return err.Error() == "script_rejected"
 }
@@ -77,18 +90,33 @@ func NewScriptableTransformer(activateOnTags []string, logCfg *STLogConfig, para
 	if err != nil {
 		return nil, err
 	}
-	if t.Script != "" {
-		t._script = t.Script
-		return &t, nil
+	if t.ErrorStatus == 0 {
+		t.ErrorStatus = http.StatusInternalServerError
+	}
+	if err = checkScriptStatus(t.ErrorStatus); err != nil {
+		return nil, err
 	}
-	if t.Path != "" {
-		data, err := os.ReadFile(t.Path)
+	script, err := loadScript(t.Script, t.Path)
+	if err != nil {
+		return nil, err
+	}
+	if t._pool, err = NewScriptPool(t.Path, script, t.ScriptLimits, t.log); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// loadScript returns the script, either inline or read from the path
+func loadScript(script string, path string) (string, error) {
+	if script != "" {
+		return script, nil
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-		t._script = string(data)
-		return &t, nil
+		return string(data), nil
 	}
-	return nil, errors.New("scriptable_transformer_no_config")
-
+	return "", errors.New("scriptable_transformer_no_config")
 }
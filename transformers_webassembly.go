@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// the kinds of message a plugin can operate on, as passed to the host functions
+const (
+	wasmRequest  uint32 = 0
+	wasmResponse uint32 = 1
+)
+
+// wasmWrapperKey is the context key of the wrapper a plugin is running for
+type wasmWrapperKey struct{}
+
+// WasmTransformer is a transformer that runs a WebAssembly plugin
+// Path is the path to the .wasm module
+// PoolSize is the maximum number of concurrent executions. Defaults to the number of CPUs
+// Timeout is the maximum duration of an execution, as a duration string. Defaults to 1s
+// RejectStatus is the status code of the response when the plugin rejects the transaction. Defaults to 403
+// ErrorStatus is the status code of the response when the plugin fails. Defaults to 500
+// _runtime is the WebAssembly runtime, hosting the ABI
+// _module is the compiled module
+// _instances holds the idle instances of the module. A nil instance is a free slot, which gets a new instance when
+// acquired
+// _timeout is the parsed version of Timeout
+type WasmTransformer struct {
+	Path           string
+	PoolSize       int
+	Timeout        string
+	RejectStatus   int
+	ErrorStatus    int
+	ExpandRequest  bool
+	ExpandResponse bool
+	ActivateOnTags []string
+	log            *STLogHelper
+	_runtime       wazero.Runtime
+	_module        wazero.CompiledModule
+	_instances     chan api.Module
+	_timeout       time.Duration
+}
+
+// Transform will perform the transformation. The plugin must return 0 for the transaction to move forward. Any other
+// value rejects the transaction
+func (t *WasmTransformer) Transform(wrapper *APIWrapper) (*APIWrapper, error) {
+	res, err := t.run(wrapper)
+	if err != nil {
+		if wrapper.TimedOut() {
+			return wrapper, wrapper.Context.Err()
+		}
+		t.log.LogErr("error while running plugin", err, wrapper, t.log.Error)
+		return wrapper, &ScriptResponse{Status: t.ErrorStatus, Headers: http.Header{}}
+	}
+	if res != 0 {
+		return wrapper, errors.New("wasm_rejected")
+	}
+	return wrapper, nil
+}
+
+// run calls the transform function of an instance of the module, and returns its result. If all the instances are
+// busy, it waits for one to become available. If the transaction is done or the timeout expires while the plugin is
+// running, the plugin is stopped
+func (t *WasmTransformer) run(wrapper *APIWrapper) (uint32, error) {
+	var instance api.Module
+	select {
+	case instance = <-t._instances:
+	case <-wrapper.GetContext().Done():
+		return 0, wrapper.GetContext().Err()
+	}
+	ctx, cancel := context.WithTimeout(wrapper.GetContext(), t._timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, wasmWrapperKey{}, wrapper)
+	res, err := t.call(ctx, instance)
+	// an instance that failed may be in any state, so its slot is freed rather than risking to reuse it
+	if err != nil && res.instance != nil {
+		_ = res.instance.Close(context.Background())
+		res.instance = nil
+	}
+	t._instances <- res.instance
+	return res.value, err
+}
+
+// wasmResult is the outcome of a call to a plugin, along with the instance that served it
+type wasmResult struct {
+	instance api.Module
+	value    uint32
+}
+
+// call calls the transform function, creating the instance first if needed, and publishes the execution time, in
+// microseconds
+func (t *WasmTransformer) call(ctx context.Context, instance api.Module) (wasmResult, error) {
+	res := wasmResult{instance: instance}
+	if instance == nil {
+		var err error
+		// instances are anonymous, so that many of them can live in the same runtime
+		config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize", "_start")
+		if res.instance, err = t._runtime.InstantiateModule(ctx, t._module, config); err != nil {
+			return res, err
+		}
+	}
+	transform := res.instance.ExportedFunction("transform")
+	if transform == nil {
+		return res, errors.New("the plugin does not export the transform function")
+	}
+	start := time.Now()
+	values, err := transform.Call(ctx)
+	t.log.PrometheusSummaryObserve("wasm_execution", time.Since(start).Microseconds())
+	if err != nil {
+		return res, err
+	}
+	if len(values) != 1 {
+		return res, errors.New("the transform function of the plugin must return an i32")
+	}
+	res.value = api.DecodeU32(values[0])
+	return res, nil
+}
+
+func (t *WasmTransformer) ErrorMatches(err error) bool {
+	return err.Error() == "wasm_rejected"
+}
+
+func (t *WasmTransformer) HandleError(writer *http.ResponseWriter) {
+	(*writer).WriteHeader(t.RejectStatus)
+}
+
+func (t *WasmTransformer) ShouldExpandRequest() bool {
+	return t.ExpandRequest
+}
+
+func (t *WasmTransformer) ShouldExpandResponse() bool {
+	return t.ExpandResponse
+}
+
+func (t *WasmTransformer) IsActive(wrapper *APIWrapper) bool {
+	return wrapper.HasTag(t.ActivateOnTags)
+}
+
+// NewWasmTransformer is the constructor for WasmTransformer. The module is compiled once, and its instances are created
+// on demand, up to the pool size
+func NewWasmTransformer(activateOnTags []string, logCfg *STLogConfig, params map[string]any) (*WasmTransformer, error) {
+	t := WasmTransformer{ActivateOnTags: activateOnTags, log: NewSTLogHelper(logCfg), _timeout: time.Second}
+	err := template.DecodeAndTempl(context.Background(), params, &t, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if t.Path == "" {
+		return nil, errors.New("wasm_transformer_no_path")
+	}
+	if t.Timeout != "" {
+		if t._timeout, err = time.ParseDuration(t.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	if t.RejectStatus == 0 {
+		t.RejectStatus = http.StatusForbidden
+	}
+	if t.ErrorStatus == 0 {
+		t.ErrorStatus = http.StatusInternalServerError
+	}
+	if err = checkScriptStatus(t.RejectStatus); err != nil {
+		return nil, err
+	}
+	if err = checkScriptStatus(t.ErrorStatus); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	// the executions are stopped when their context is done, so that the timeout is enforced
+	t._runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	// WASI is available, as TinyGo and the wasm32-wasi Rust target depend on it
+	if _, err = wasi_snapshot_preview1.Instantiate(ctx, t._runtime); err != nil {
+		return nil, err
+	}
+	if _, err = newWasmHostModule(t._runtime, t.log).Instantiate(ctx); err != nil {
+		return nil, err
+	}
+	if t._module, err = t._runtime.CompileModule(ctx, data); err != nil {
+		return nil, err
+	}
+	size := t.PoolSize
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	t._instances = make(chan api.Module, size)
+	for i := 0; i < size; i++ {
+		t._instances <- nil
+	}
+	t.log.PrometheusRegisterSummary("wasm_execution")
+	return &t, nil
+}
+
+// newWasmHostModule builds the "redplant" module, exposing the ABI to the plugins. Strings and bodies are passed as
+// pointer and length pairs. The functions returning data write it to a buffer provided by the plugin, up to its limit,
+// and return the full length of the data, so that the plugin can retry with a larger buffer
+func newWasmHostModule(r wazero.Runtime, logger *STLogHelper) wazero.HostModuleBuilder {
+	return r.NewHostModuleBuilder("redplant").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, namePtr, nameLen, bufPtr, bufLimit uint32) int32 {
+		header := wasmHeader(ctx, kind)
+		name := string(wasmRead(m, namePtr, nameLen))
+		if header == nil || len(header.Values(name)) == 0 {
+			return -1
+		}
+		return wasmWrite(m, []byte(header.Get(name)), bufPtr, bufLimit)
+	}).Export("get_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, namePtr, nameLen, valuePtr, valueLen uint32) {
+		if header := wasmHeader(ctx, kind); header != nil {
+			header.Set(string(wasmRead(m, namePtr, nameLen)), string(wasmRead(m, valuePtr, valueLen)))
+		}
+	}).Export("set_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, namePtr, nameLen uint32) {
+		if header := wasmHeader(ctx, kind); header != nil {
+			header.Del(string(wasmRead(m, namePtr, nameLen)))
+		}
+	}).Export("delete_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, bufPtr, bufLimit uint32) int32 {
+		wrapper := wasmWrapper(ctx)
+		if kind == wasmRequest {
+			return wasmWrite(m, wrapper.Request.ExpandedBody, bufPtr, bufLimit)
+		}
+		if kind == wasmResponse && wrapper.Response != nil {
+			return wasmWrite(m, wrapper.Response.ExpandedBody, bufPtr, bufLimit)
+		}
+		return -1
+	}).Export("get_body").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, ptr, size uint32) {
+		wrapper := wasmWrapper(ctx)
+		// the body is copied, as the memory of the instance is reused by the next executions
+		data := append([]byte{}, wasmRead(m, ptr, size)...)
+		if kind == wasmRequest {
+			wrapper.Request.SetBody(data)
+		} else if kind == wasmResponse && wrapper.Response != nil {
+			wrapper.Response.SetBody(data)
+		}
+	}).Export("set_body").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context) int32 {
+		if wrapper := wasmWrapper(ctx); wrapper.Response != nil {
+			return int32(wrapper.Response.StatusCode)
+		}
+		return 0
+	}).Export("get_status").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, status uint32) {
+		wrapper := wasmWrapper(ctx)
+		if wrapper.Response == nil {
+			return
+		}
+		// a status code that can't be written to the client is ignored
+		if checkScriptStatus(int(status)) != nil {
+			logger.LogErr("plugin set an invalid status code: "+strconv.FormatUint(uint64(status), 10), nil, wrapper, logger.Warn)
+			return
+		}
+		wrapper.Response.StatusCode = int(status)
+	}).Export("set_status").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) int32 {
+		if stringInArray(string(wasmRead(m, ptr, size)), wasmWrapper(ctx).Tags) {
+			return 1
+		}
+		return 0
+	}).Export("has_tag").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+		wrapper := wasmWrapper(ctx)
+		wrapper.Tags = append(wrapper.Tags, string(wasmRead(m, ptr, size)))
+	}).Export("add_tag").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+		logger.Log(string(wasmRead(m, ptr, size)), wasmWrapper(ctx), logger.Info)
+	}).Export("log")
+}
+
+// wasmWrapper returns the wrapper the plugin is running for
+func wasmWrapper(ctx context.Context) *APIWrapper {
+	return ctx.Value(wasmWrapperKey{}).(*APIWrapper)
+}
+
+// wasmHeader returns the headers of the given kind of message, or nil if the message is not available
+func wasmHeader(ctx context.Context, kind uint32) http.Header {
+	wrapper := wasmWrapper(ctx)
+	if kind == wasmRequest {
+		return wrapper.Request.Header
+	}
+	if kind == wasmResponse && wrapper.Response != nil {
+		return wrapper.Response.Header
+	}
+	return nil
+}
+
+// wasmRead returns a view of the memory of the plugin. An out of range access makes the execution fail
+func wasmRead(m api.Module, ptr uint32, size uint32) []byte {
+	data, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		panic(errors.New("out of range memory access by the plugin"))
+	}
+	return data
+}
+
+// wasmWrite writes the data to the buffer of the plugin, up to its limit, and returns the full length of the data
+func wasmWrite(m api.Module, data []byte, ptr uint32, limit uint32) int32 {
+	size := uint32(len(data))
+	if size > limit {
+		size = limit
+	}
+	if !m.Memory().Write(ptr, data[:size]) {
+		panic(errors.New("out of range memory access by the plugin"))
+	}
+	return int32(len(data))
+}
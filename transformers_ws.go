@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// IWSTransformer is the interface for all websocket message transformers
+// Transform will transform the message. If an error is returned, the message is rejected
+// IsActive will return true if the transformer is interested in this message
+type IWSTransformer interface {
+	Transform(message *WSMessage) (*WSMessage, error)
+	IsActive(message *WSMessage) bool
+}
+
+// WSTransformers is the store for all the transformers of a websocket pipeline
+type WSTransformers struct {
+	transformers []IWSTransformer
+}
+
+// Transform will process all the transformers for the given message
+func (t *WSTransformers) Transform(message *WSMessage) (*WSMessage, error) {
+	for _, transformer := range t.transformers {
+		if transformer.IsActive(message) {
+			var err error
+			if message, err = transformer.Transform(message); err != nil {
+				return message, err
+			}
+		}
+	}
+	return message, nil
+}
+
+// Push will append a transformer to the transformers
+func (t *WSTransformers) Push(transformer IWSTransformer) {
+	t.transformers = append(t.transformers, transformer)
+}
+
+// NewWSTransformers initializes all websocket transformers, based on their configurations
+func NewWSTransformers(transformers []TransformerConfig) (*WSTransformers, error) {
+	res := WSTransformers{}
+	var err error
+	for _, t := range transformers {
+		var transformer IWSTransformer
+		switch t.Id {
+		case "barrage":
+			transformer, err = NewWSBarrageTransformer(t.ActivateOnTags, t.Logging, t.Params)
+		case "rate-limiter":
+			transformer, err = NewWSRateLimiterTransformer(t.ActivateOnTags, t.Logging, t.Params)
+		case "scriptable":
+			transformer, err = NewWSScriptableTransformer(t.ActivateOnTags, t.Logging, t.Params)
+		default:
+			err = errors.New("unknown websocket transformer: " + t.Id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Push(transformer)
+	}
+	return &res, nil
+}
+
+// wsMessageMeta extracts meaningful metadata from a message for logging purposes
+func wsMessageMeta(message *WSMessage) AnyMap {
+	return AnyMap{"direction": message.Direction, "type": message.TypeName(), "size": len(message.Data)}
+}
+
+// WSBarrageTransformer is a transformer that will reject the messages matching a regular expression
+// BodyRegexp is a regular expression for a forbidden message
+// _bodyRegexp is the compiled version of BodyRegexp
+// ActivateOnTags is a list of tags for which this plugin will activate. Leave empty for "always"
+type WSBarrageTransformer struct {
+	BodyRegexp     string
+	_bodyRegexp    *regexp.Regexp
+	ActivateOnTags []string
+	log            *STLogHelper
+}
+
+// NewWSBarrageTransformer is the constructor for WSBarrageTransformer
+func NewWSBarrageTransformer(activateOnTags []string, logCfg *STLogConfig, params map[string]any) (*WSBarrageTransformer, error) {
+	t := WSBarrageTransformer{ActivateOnTags: activateOnTags, log: NewSTLogHelper(logCfg)}
+	err := template.DecodeAndTempl(context.Background(), params, &t, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if t.BodyRegexp != "" {
+		if t._bodyRegexp, err = regexp.Compile(t.BodyRegexp); err != nil {
+			return nil, err
+		}
+	}
+	t.log.PrometheusRegisterCounter("ws_barraged")
+	return &t, nil
+}
+
+// Transform will reject the message if it matches the regular expression
+func (t *WSBarrageTransformer) Transform(message *WSMessage) (*WSMessage, error) {
+	if t._bodyRegexp != nil && t._bodyRegexp.Match(message.Data) {
+		t.log.PrometheusCounterInc("ws_barraged")
+		t.log.LogWithMeta("websocket message barraged", message.Connection.Wrapper, wsMessageMeta(message), t.log.Debug)
+		return message, errors.New("barrage")
+	}
+	return message, nil
+}
+
+func (t *WSBarrageTransformer) IsActive(message *WSMessage) bool {
+	return message.Connection.Wrapper.HasTag(t.ActivateOnTags)
+}
+
+// WSRateLimiterTransformer is a transformer that limits the number of messages per connection in a time window
+// Limit is the maximum number of messages in the time window
+// Range is the duration of the time window
+// _range is the parsed version of Range
+// ActivateOnTags is a list of tags for which this plugin will activate. Leave empty for "always"
+type WSRateLimiterTransformer struct {
+	Limit          int64
+	Range          string
+	_range         time.Duration
+	ActivateOnTags []string
+	log            *STLogHelper
+}
+
+// wsRateWindow is the time window of a rate limiter for one connection
+type wsRateWindow struct {
+	start time.Time
+	count int64
+	lock  sync.Mutex
+}
+
+// NewWSRateLimiterTransformer is the constructor for WSRateLimiterTransformer
+func NewWSRateLimiterTransformer(activateOnTags []string, logCfg *STLogConfig, params map[string]any) (*WSRateLimiterTransformer, error) {
+	t := WSRateLimiterTransformer{ActivateOnTags: activateOnTags, log: NewSTLogHelper(logCfg)}
+	err := template.DecodeAndTempl(context.Background(), params, &t, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if t._range, err = time.ParseDuration(t.Range); err != nil {
+		return nil, err
+	}
+	t.log.PrometheusRegisterCounter("ws_rate_limited")
+	return &t, nil
+}
+
+// Transform will reject the message if the connection exceeded the limit in the current time window
+func (t *WSRateLimiterTransformer) Transform(message *WSMessage) (*WSMessage, error) {
+	// each transformer keeps its own window in the connection state
+	value, _ := message.Connection.state.LoadOrStore(t, &wsRateWindow{start: message.Time})
+	window := value.(*wsRateWindow)
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	if message.Time.Sub(window.start) >= t._range {
+		window.start = message.Time
+		window.count = 0
+	}
+	window.count++
+	if window.count > t.Limit {
+		t.log.PrometheusCounterInc("ws_rate_limited")
+		t.log.LogWithMeta("websocket message rate limited", message.Connection.Wrapper, wsMessageMeta(message), t.log.Debug)
+		return message, errors.New("rate_limit")
+	}
+	return message, nil
+}
+
+func (t *WSRateLimiterTransformer) IsActive(message *WSMessage) bool {
+	return message.Connection.Wrapper.HasTag(t.ActivateOnTags)
+}
+
+// WSScriptableTransformer is a transformer that uses a JavaScript script to filter and modify the messages
+// Script is the script
+// Path is the path to a file containing the script, as an alternative to Script
+// ScriptLimits are the limits of the executions of the script
+// ActivateOnTags is a list of tags for which this plugin will activate. Leave empty for "always"
+// _pool is the pool of runtimes running the compiled script
+type WSScriptableTransformer struct {
+	Script         string
+	Path           string
+	ScriptLimits   `mapstructure:",squash"`
+	_pool          *ScriptPool
+	ActivateOnTags []string
+	log            *STLogHelper
+}
+
+// NewWSScriptableTransformer is the constructor for WSScriptableTransformer
+func NewWSScriptableTransformer(activateOnTags []string, logCfg *STLogConfig, params map[string]any) (*WSScriptableTransformer, error) {
+	t := WSScriptableTransformer{ActivateOnTags: activateOnTags, log: NewSTLogHelper(logCfg)}
+	err := template.DecodeAndTempl(context.Background(), params, &t, nil, []string{})
+	if err != nil {
+		return nil, err
+	}
+	script, err := loadScript(t.Script, t.Path)
+	if err != nil {
+		return nil, err
+	}
+	if t._pool, err = NewScriptPool(t.Path, script, t.ScriptLimits, t.log); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Transform will run the script. The script receives the message as `message` and the transaction that opened the
+// connection as `transaction`, along with the deprecated `wrapper`. It can change `message.data` and must return true
+// if the message should move forward
+func (t *WSScriptableTransformer) Transform(message *WSMessage) (*WSMessage, error) {
+	scriptMessage := map[string]any{"direction": message.Direction, "type": message.TypeName(),
+		"data": string(message.Data), "connection": message.Connection.ID}
+	api := scriptAPI{wrapper: message.Connection.Wrapper, log: t.log}
+	val, err := t._pool.Run(context.Background(), map[string]any{"message": scriptMessage, "transaction": api.transactionObject(),
+		"log": api.logObject(), "metrics": api.metricsObject(), "wrapper": message.Connection.Wrapper})
+	if err != nil {
+		t.log.LogWithErrorMeta("error while running script", err, message.Connection.Wrapper, wsMessageMeta(message), t.log.Error)
+		return message, err
+	}
+	res, ok := val.(bool)
+	if !ok {
+		t.log.LogWithErrorMeta("script did not return a boolean", nil, message.Connection.Wrapper, wsMessageMeta(message), t.log.Error)
+		return message, errors.New("script did not return a boolean")
+	}
+	if !res {
+		return message, errors.New("script_rejected")
+	}
+	if data, ok := scriptMessage["data"].(string); ok {
+		message.Data = []byte(data)
+	}
+	return message, nil
+}
+
+func (t *WSScriptableTransformer) IsActive(message *WSMessage) bool {
+	return message.Connection.Wrapper.HasTag(t.ActivateOnTags)
+}
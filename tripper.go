@@ -57,15 +57,25 @@ func (rtf *RoundTripperFilter) RoundTrip(r *http.Request) (*http.Response, error
 	scheme := wrapper.Request.URL.Scheme
 	switch scheme {
 	case "file":
-		return FileTrip(r)
+		return FileTrip(r, wrapper.Rule)
 	case "postgres":
-		return DBTrip(r, wrapper.Rule)
+		return DBTrip(r, wrapper)
 	case "mysql":
-		return DBTrip(r, wrapper.Rule)
+		return DBTrip(r, wrapper)
+	case "sqlite":
+		return DBTrip(r, wrapper)
 	case "ws", "wss":
 		return WSTripper(r, wrapper.Rule)
 	case "none":
 		return NoneTrip(r)
+	case "mock":
+		return MockTrip(r, wrapper)
+	case "grpc", "grpcs":
+		return GRPCTrip(r, wrapper)
+	case "exec":
+		return ExecTrip(r, wrapper)
+	case "fcgi", "fcgi+unix":
+		return FCGITrip(r, wrapper)
 	default:
 		return rtf.parent.RoundTrip(r)
 	}
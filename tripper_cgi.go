@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// cgiVariables composes the CGI meta-variables describing the request, shared by the exec and the FastCGI origins
+func cgiVariables(request *http.Request, wrapper *APIWrapper) map[string]string {
+	host, port, err := net.SplitHostPort(request.Host)
+	if err != nil {
+		host = request.Host
+		port = "80"
+	}
+	variables := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "redplant",
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"SERVER_PROTOCOL":   request.Proto,
+		"REQUEST_METHOD":    request.Method,
+		"QUERY_STRING":      request.URL.RawQuery,
+		"REMOTE_ADDR":       wrapper.RealIP,
+		"REDPLANT_ID":       wrapper.ID,
+	}
+	if wrapper.Username != "" {
+		variables["REMOTE_USER"] = wrapper.Username
+	}
+	if request.ContentLength > 0 {
+		variables["CONTENT_LENGTH"] = strconv.FormatInt(request.ContentLength, 10)
+	}
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		variables["CONTENT_TYPE"] = contentType
+	}
+	for key, values := range request.Header {
+		key = strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		// the Proxy header would end up in HTTP_PROXY, which many tools use as their proxy (httpoxy)
+		if key == "PROXY" || key == "CONTENT_TYPE" || key == "CONTENT_LENGTH" {
+			continue
+		}
+		variables["HTTP_"+key] = strings.Join(values, ", ")
+	}
+	return variables
+}
+
+// readCGIResponse reads the headers of a CGI response and composes the http.Response. The optional Status header sets
+// the status code. Without it, the status is 200, or 302 if a Location header is present. The body is left to the
+// caller
+func readCGIResponse(request *http.Request, reader *bufio.Reader) (*http.Response, error) {
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	response := statusResponse(request, http.StatusOK)
+	response.Header = http.Header(header)
+	response.ContentLength = -1
+	if status := header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil || code < 100 || code > 999 {
+			return nil, errors.New("invalid status: " + status)
+		}
+		response.StatusCode = code
+		response.Header.Del("Status")
+	} else if header.Get("Location") != "" {
+		response.StatusCode = http.StatusFound
+	}
+	response.Status = strconv.Itoa(response.StatusCode) + " " + http.StatusText(response.StatusCode)
+	if contentLength, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		response.ContentLength = contentLength
+	}
+	return response, nil
+}
@@ -1,93 +1,453 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"github.com/jmoiron/sqlx"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// DBTrip will perform the request to a database and compose the http response
-func DBTrip(request *http.Request, rule *Rule) (*http.Response, error) {
-	// the request body contains the query
-	queryData, _ := io.ReadAll(request.Body)
-	query := string(queryData)
-	// performing the query
-	rows, err := rule.db.Query(query)
-	if err != nil {
-		return nil, err
+// DBConfig is the configuration of a database origin
+// RawSQL if set to true, will allow requests with no matching named query to carry a SQL statement in the body
+// Queries is a map of method=named query. The query matching the request method is executed
+// MaxRows is the maximum number of rows a response can contain. Zero means no limit
+// Timeout is the maximum duration of a query, including the time it takes to stream the rows
+// Pagination if set, will paginate the results of the named queries, or of the REST collections
+// Rest if set, will expose the database tables as REST resources, instead of running named queries
+// ReadOnly if set to true, will run the queries in read-only transactions
+// Pool is the configuration of the connection pool
+// RequireConnection if set to true, will stop RedPlant from starting when the database cannot be reached
+// _timeout is the parsed version of Timeout
+type DBConfig struct {
+	RawSQL            bool                `yaml:"rawSQL"`
+	Queries           map[string]*DBQuery `yaml:"queries"`
+	MaxRows           int                 `yaml:"maxRows"`
+	Timeout           string              `yaml:"timeout"`
+	Pagination        *DBPagination       `yaml:"pagination"`
+	Rest              *DBRestConfig       `yaml:"rest"`
+	ReadOnly          bool                `yaml:"readOnly"`
+	Pool              *DBPoolConfig       `yaml:"pool"`
+	RequireConnection bool                `yaml:"requireConnection"`
+	_timeout          time.Duration
+}
+
+// DBPoolConfig is the configuration of the connection pool of a database origin
+// MaxOpen is the maximum number of open connections. Zero means no limit
+// MaxIdle is the maximum number of idle connections. Defaults to 2
+// MaxLifetime is the maximum amount of time a connection can be reused, as in 1h. Defaults to no limit
+// MaxIdleTime is the maximum amount of time a connection can be idle, as in 5m. Defaults to no limit
+type DBPoolConfig struct {
+	MaxOpen     int    `yaml:"maxOpen"`
+	MaxIdle     int    `yaml:"maxIdle"`
+	MaxLifetime string `yaml:"maxLifetime"`
+	MaxIdleTime string `yaml:"maxIdleTime"`
+}
+
+// DBPagination is the configuration of the pagination of the results
+// Mode is either "offset", for limit/offset pagination, or "keyset", for pages starting after the key of the last row
+// of the previous page. Defaults to "offset"
+// Limit is the default page size. Defaults to 20
+// MaxLimit is the maximum page size a client can request. Defaults to 100
+// Key is the column holding the key of the rows, in keyset mode. REST resources use the key of the tables
+// Start is the key the first page starts after, in keyset mode
+type DBPagination struct {
+	Mode     string `yaml:"mode"`
+	Limit    int    `yaml:"limit"`
+	MaxLimit int    `yaml:"maxLimit"`
+	Key      string `yaml:"key"`
+	Start    string `yaml:"start"`
+}
+
+// dbPage is a page of results, as requested by a client
+// key is the column holding the key of the rows, in keyset mode
+type dbPage struct {
+	limit  int
+	offset int
+	after  string
+	key    string
+}
+
+// DBQuery is a parameterized query
+// Statement is the SQL statement, where parameters are referenced as :name
+// Params is a map of name=template. Templates are evaluated against the API transaction to obtain the bind values
+type DBQuery struct {
+	Statement string    `yaml:"statement"`
+	Params    StringMap `yaml:"params"`
+}
+
+// FindQuery returns the named query for the provided method, or nil if none is configured
+func (c *DBConfig) FindQuery(method string) *DBQuery {
+	if c == nil {
+		return nil
+	}
+	return c.Queries[strings.ToLower(method)]
+}
+
+// IsRawSQL returns true if raw SQL statements in the request body are allowed
+func (c *DBConfig) IsRawSQL() bool {
+	return c != nil && c.RawSQL
+}
+
+// Init will parse the timeout and initialize the pagination
+func (c *DBConfig) Init() error {
+	if c == nil {
+		return nil
+	}
+	if c.Timeout != "" {
+		var err error
+		if c._timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return err
+		}
+	}
+	if c.Pagination != nil {
+		if err := c.Pagination.Init(c.IsRest()); err != nil {
+			return err
+		}
+	}
+	return c.Rest.Init()
+}
+
+// GetTimeout returns the maximum duration of a query. Zero means no limit
+func (c *DBConfig) GetTimeout() time.Duration {
+	if c == nil {
+		return 0
 	}
-	// turning the rows into JSON
-	body, err := toJSON(rows)
+	return c._timeout
+}
+
+// IsReadOnly returns true if the queries run in read-only transactions
+func (c *DBConfig) IsReadOnly() bool {
+	return c != nil && c.ReadOnly
+}
+
+// Open will open the database and configure the connection pool
+func (c *DBConfig) Open(driver string, dsn string) (*sqlx.DB, error) {
+	db, err := sqlx.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
-	response := http.Response{StatusCode: 200, Request: request, Uncompressed: true}
-	response.Header = http.Header{}
+	if c != nil && c.Pool != nil {
+		if err = c.Pool.Apply(db); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	// every connection to an in-memory SQLite database is a different database, so we can only have one
+	if driver == "sqlite" && strings.HasPrefix(dsn, ":memory:") {
+		db.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
 
-	response.Header.Set("content-type", "application/json")
-	response.Body = io.NopCloser(bytes.NewReader(body))
-	return &response, nil
+// Ping will check that the database can be reached
+func (c *DBConfig) Ping(db *sqlx.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return db.PingContext(ctx)
 }
 
-// toJSON will convert database rows into JSON
-func toJSON(rows *sql.Rows) ([]byte, error) {
-	columnTypes, err := rows.ColumnTypes()
+// Session prepares the execution of queries. The returned context is bound to the provided context and to the
+// timeout, if any. If ReadOnly is set, the queries run in a read-only transaction. The returned function ends the
+// transaction and cancels the context, so it needs to be called once the rows are consumed
+func (c *DBConfig) Session(ctx context.Context, db *sqlx.DB) (context.Context, sqlx.ExtContext, context.CancelFunc, error) {
+	var cancel context.CancelFunc
+	if timeout := c.GetTimeout(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	if !c.IsReadOnly() {
+		return ctx, db, cancel, nil
+	}
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		return nil, err
+		cancel()
+		return nil, nil, nil, err
 	}
-	count := len(columnTypes)
-	finalRows := make([]any, 0)
-	for rows.Next() {
-		scanArgs := make([]any, count)
-		for i, v := range columnTypes {
-			switch v.DatabaseTypeName() {
-			case "VARCHAR", "TEXT", "UUID", "TIMESTAMP":
-				scanArgs[i] = new(sql.NullString)
-				break
-			case "BOOL":
-				scanArgs[i] = new(sql.NullBool)
-				break
-			case "INT4":
-				scanArgs[i] = new(sql.NullInt64)
-				break
-			case "INT":
-				scanArgs[i] = new(sql.NullInt64)
-				break
-			default:
-				scanArgs[i] = new(sql.NullString)
+	return ctx, tx, func() {
+		// nothing can be written in a read-only transaction, so there's nothing to commit
+		_ = tx.Rollback()
+		cancel()
+	}, nil
+}
+
+// Apply will configure the connection pool of the database
+func (p *DBPoolConfig) Apply(db *sqlx.DB) error {
+	if p.MaxLifetime != "" {
+		lifetime, err := time.ParseDuration(p.MaxLifetime)
+		if err != nil {
+			return err
+		}
+		db.SetConnMaxLifetime(lifetime)
+	}
+	if p.MaxIdleTime != "" {
+		idleTime, err := time.ParseDuration(p.MaxIdleTime)
+		if err != nil {
+			return err
+		}
+		db.SetConnMaxIdleTime(idleTime)
+	}
+	if p.MaxIdle != 0 {
+		db.SetMaxIdleConns(p.MaxIdle)
+	}
+	db.SetMaxOpenConns(p.MaxOpen)
+	return nil
+}
+
+// IsRest returns true if the tables are exposed as REST resources
+func (c *DBConfig) IsRest() bool {
+	return c != nil && c.Rest != nil
+}
+
+// GetMaxRows returns the maximum number of rows a response can contain. Zero means no limit
+func (c *DBConfig) GetMaxRows() int {
+	if c == nil {
+		return 0
+	}
+	return c.MaxRows
+}
+
+// Init will validate the pagination configuration and set the defaults. When the pagination applies to REST
+// resources, the key is the key of the tables, so it's not required
+func (p *DBPagination) Init(rest bool) error {
+	if p.Mode == "" {
+		p.Mode = "offset"
+	}
+	if p.Mode != "offset" && p.Mode != "keyset" {
+		return errors.New("unknown pagination mode: " + p.Mode)
+	}
+	if p.Mode == "keyset" && p.Key == "" && !rest {
+		return errors.New("keyset pagination requires a key")
+	}
+	if p.MaxLimit <= 0 {
+		p.MaxLimit = 100
+	}
+	if p.Limit <= 0 {
+		p.Limit = 20
+	}
+	if p.Limit > p.MaxLimit {
+		p.Limit = p.MaxLimit
+	}
+	return nil
+}
+
+// RequestedPage returns the page requested by the client with the limit, offset and after query parameters.
+// Missing or invalid values are replaced by the defaults
+func (p *DBPagination) RequestedPage(query url.Values) dbPage {
+	page := dbPage{limit: p.Limit, after: p.Start, key: p.Key}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		page.limit = limit
+	}
+	if page.limit > p.MaxLimit {
+		page.limit = p.MaxLimit
+	}
+	if offset, err := strconv.Atoi(query.Get("offset")); err == nil && offset > 0 {
+		page.offset = offset
+	}
+	if after := query.Get("after"); after != "" {
+		page.after = after
+	}
+	return page
+}
+
+// Bind adds the page parameters to the bind values of a query. In offset mode, the parameters are :limit and :offset.
+// In keyset mode, the parameters are :limit and :after
+func (p *DBPagination) Bind(page dbPage, values map[string]any) {
+	values["limit"] = page.limit
+	if p.Mode == "keyset" {
+		values["after"] = page.after
+	} else {
+		values["offset"] = page.offset
+	}
+}
+
+// Links composes the Link header for a page of results. The links are relative to the request URL, and retain all the
+// other query parameters
+func (p *DBPagination) Links(requestURL *url.URL, page dbPage, columns []string, rows [][]any) string {
+	links := make([]string, 0)
+	link := func(rel string, params map[string]string) {
+		query := requestURL.Query()
+		for k, v := range params {
+			query.Set(k, v)
+		}
+		links = append(links, "<?"+query.Encode()+">; rel=\""+rel+"\"")
+	}
+	limit := strconv.Itoa(page.limit)
+	if p.Mode == "keyset" {
+		// a full page means there may be more rows after the last one
+		if len(rows) >= page.limit && len(rows) > 0 {
+			for i, column := range columns {
+				if column == page.key {
+					link("next", map[string]string{"limit": limit, "after": formatDBValue(rows[len(rows)-1][i])})
+				}
 			}
 		}
-		err := rows.Scan(scanArgs...)
+		return strings.Join(links, ", ")
+	}
+	if len(rows) >= page.limit {
+		link("next", map[string]string{"limit": limit, "offset": strconv.Itoa(page.offset + page.limit)})
+	}
+	if page.offset > 0 {
+		prev := page.offset - page.limit
+		if prev < 0 {
+			prev = 0
+		}
+		link("prev", map[string]string{"limit": limit, "offset": strconv.Itoa(prev)})
+	}
+	return strings.Join(links, ", ")
+}
+
+// BindValues evaluates the parameter templates against the API transaction
+func (q *DBQuery) BindValues(wrapper *APIWrapper) (map[string]any, error) {
+	values := make(map[string]any)
+	for name, param := range q.Params {
+		value, err := wrapper.Templ(wrapper.Context, param)
 		if err != nil {
 			return nil, err
 		}
-		masterData := map[string]any{}
-		for i, v := range columnTypes {
-			if z, ok := (scanArgs[i]).(*sql.NullBool); ok {
-				masterData[v.Name()] = z.Bool
-				continue
-			}
-			if z, ok := (scanArgs[i]).(*sql.NullString); ok {
-				masterData[v.Name()] = z.String
-				continue
-			}
-			if z, ok := (scanArgs[i]).(*sql.NullInt64); ok {
-				masterData[v.Name()] = z.Int64
-				continue
+		values[name] = value
+	}
+	return values, nil
+}
+
+// DBTrip will perform the request to a database and compose the http response.
+// The rows are streamed in the format requested by the Accept header: a JSON array, NDJSON or CSV
+func DBTrip(request *http.Request, wrapper *APIWrapper) (*http.Response, error) {
+	rule := wrapper.Rule
+	if rule.Database.IsRest() {
+		return DBRestTrip(request, wrapper)
+	}
+	ctx, session, cancel, err := rule.Database.Session(request.Context(), rule.db)
+	if err != nil {
+		return nil, err
+	}
+	rows, page, err := queryDB(ctx, session, request, wrapper)
+	if err != nil || rows == nil {
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		return statusResponse(request, http.StatusMethodNotAllowed), nil
+	}
+	return streamDBRows(request, rule.Database, rows, page, cancel)
+}
+
+// streamDBRows composes a response streaming the rows in the format requested by the client. If page is not nil, the
+// rows are paginated. cancel is called once the rows are consumed
+func streamDBRows(request *http.Request, database *DBConfig, rows *sql.Rows, page *dbPage, cancel context.CancelFunc) (*http.Response, error) {
+	release := func() {
+		_ = rows.Close()
+		cancel()
+	}
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	columns := make([]string, len(columnTypes))
+	for i, v := range columnTypes {
+		columns[i] = v.Name()
+	}
+	contentType := negotiateDBFormat(request.Header.Get("accept"))
+	response := http.Response{StatusCode: 200, Request: request, Uncompressed: true, Header: http.Header{}, ContentLength: -1}
+	response.Header.Set("content-type", contentType)
+	maxRows := database.GetMaxRows()
+	next := func() ([]any, error) {
+		return readDBRow(rows, columnTypes)
+	}
+	if page != nil {
+		// pages are bounded by their limit, so we can collect them before responding, to compose the links
+		if maxRows == 0 || page.limit < maxRows {
+			maxRows = page.limit
+		}
+		pageRows := make([][]any, 0)
+		for len(pageRows) < maxRows {
+			row, err := next()
+			if err != nil {
+				release()
+				return nil, err
 			}
-			if z, ok := (scanArgs[i]).(*sql.NullFloat64); ok {
-				masterData[v.Name()] = z.Float64
-				continue
+			if row == nil {
+				break
 			}
-			if z, ok := (scanArgs[i]).(*sql.NullInt32); ok {
-				masterData[v.Name()] = z.Int32
-				continue
+			pageRows = append(pageRows, row)
+		}
+		if links := database.Pagination.Links(request.URL, *page, columns, pageRows); links != "" {
+			response.Header.Set("link", links)
+		}
+		next = func() ([]any, error) {
+			if len(pageRows) == 0 {
+				return nil, nil
 			}
-			masterData[v.Name()] = scanArgs[i]
+			row := pageRows[0]
+			pageRows = pageRows[1:]
+			return row, nil
 		}
-		finalRows = append(finalRows, masterData)
 	}
-	return json.Marshal(finalRows)
+	reader, pipe := io.Pipe()
+	go func() {
+		defer release()
+		// if anything goes wrong while streaming, the client will see the body being interrupted
+		_ = pipe.CloseWithError(writeDBRows(newDBRowWriter(contentType, pipe), columns, next, maxRows))
+	}()
+	response.Body = reader
+	return &response, nil
+}
+
+// queryDB runs the query matching the request, binding the values and the page, if the results are paginated.
+// If no query can be run for the request, the returned rows are nil
+func queryDB(ctx context.Context, session sqlx.ExtContext, request *http.Request, wrapper *APIWrapper) (*sql.Rows, *dbPage, error) {
+	rule := wrapper.Rule
+	if query := rule.Database.FindQuery(request.Method); query != nil {
+		// a named query is configured for this method, so we bind the values and run it
+		values, err := query.BindValues(wrapper)
+		if err != nil {
+			return nil, nil, err
+		}
+		var page *dbPage
+		if pagination := rule.Database.Pagination; pagination != nil {
+			requestedPage := pagination.RequestedPage(request.URL.Query())
+			pagination.Bind(requestedPage, values)
+			page = &requestedPage
+		}
+		namedRows, err := sqlx.NamedQueryContext(ctx, session, query.Statement, values)
+		if err != nil {
+			return nil, nil, err
+		}
+		return namedRows.Rows, page, nil
+	}
+	if rule.Database.IsRawSQL() {
+		// the request body contains the query
+		queryData, _ := io.ReadAll(request.Body)
+		rows, err := session.QueryContext(ctx, string(queryData))
+		return rows, nil, err
+	}
+	return nil, nil, nil
+}
+
+// readDBRow reads the next row, converting the values into values that faithfully represent them in JSON.
+// At the end of the rows, the returned row is nil
+func readDBRow(rows *sql.Rows, columnTypes []*sql.ColumnType) ([]any, error) {
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	// we let the driver pick the most suitable type for each value, and then convert it
+	values := make([]any, len(columnTypes))
+	scanArgs := make([]any, len(columnTypes))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	if err := rows.Scan(scanArgs...); err != nil {
+		return nil, err
+	}
+	for i, v := range columnTypes {
+		values[i] = toJSONValue(v.DatabaseTypeName(), values[i])
+	}
+	return values, nil
 }
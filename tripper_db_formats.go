@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+const (
+	dbFormatJSON   = "application/json"
+	dbFormatNDJSON = "application/x-ndjson"
+	dbFormatCSV    = "text/csv"
+)
+
+// negotiateDBFormat picks the format of a database response, based on the Accept header. The first supported media
+// type wins. Defaults to a JSON array
+func negotiateDBFormat(accept string) string {
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return dbFormatJSON
+		case "application/x-ndjson", "application/ndjson":
+			return dbFormatNDJSON
+		case "text/csv":
+			return dbFormatCSV
+		}
+	}
+	return dbFormatJSON
+}
+
+// dbRowWriter writes database rows in a specific format
+type dbRowWriter interface {
+	Begin(columns []string) error
+	Row(columns []string, values []any) error
+	End() error
+}
+
+// newDBRowWriter is the constructor for the dbRowWriter of the given format
+func newDBRowWriter(format string, writer io.Writer) dbRowWriter {
+	buffer := bufio.NewWriter(writer)
+	switch format {
+	case dbFormatNDJSON:
+		return &ndjsonRowWriter{writer: buffer}
+	case dbFormatCSV:
+		return &csvRowWriter{writer: csv.NewWriter(buffer), buffer: buffer}
+	default:
+		return &jsonRowWriter{writer: buffer}
+	}
+}
+
+// writeDBRows writes all the rows returned by next, using the provided dbRowWriter. next returns nil when there are no
+// more rows. If maxRows is greater than zero, no more than maxRows rows are written
+func writeDBRows(writer dbRowWriter, columns []string, next func() ([]any, error), maxRows int) error {
+	if err := writer.Begin(columns); err != nil {
+		return err
+	}
+	for count := 0; maxRows <= 0 || count < maxRows; count++ {
+		row, err := next()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		if err = writer.Row(columns, row); err != nil {
+			return err
+		}
+	}
+	return writer.End()
+}
+
+// rowToMap converts a row into an object, keyed by column name
+func rowToMap(columns []string, values []any) map[string]any {
+	data := make(map[string]any, len(columns))
+	for i, column := range columns {
+		data[column] = values[i]
+	}
+	return data
+}
+
+// jsonRowWriter writes rows as a JSON array of objects
+type jsonRowWriter struct {
+	writer *bufio.Writer
+	count  int
+}
+
+func (w *jsonRowWriter) Begin(_ []string) error {
+	_, err := w.writer.WriteString("[")
+	return err
+}
+
+func (w *jsonRowWriter) Row(columns []string, values []any) error {
+	data, err := json.Marshal(rowToMap(columns, values))
+	if err != nil {
+		return err
+	}
+	if w.count > 0 {
+		if err = w.writer.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	w.count++
+	_, err = w.writer.Write(data)
+	return err
+}
+
+func (w *jsonRowWriter) End() error {
+	if _, err := w.writer.WriteString("]"); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// ndjsonRowWriter writes rows as newline delimited JSON objects
+type ndjsonRowWriter struct {
+	writer *bufio.Writer
+}
+
+func (w *ndjsonRowWriter) Begin(_ []string) error {
+	return nil
+}
+
+func (w *ndjsonRowWriter) Row(columns []string, values []any) error {
+	data, err := json.Marshal(rowToMap(columns, values))
+	if err != nil {
+		return err
+	}
+	if _, err = w.writer.Write(data); err != nil {
+		return err
+	}
+	return w.writer.WriteByte('\n')
+}
+
+func (w *ndjsonRowWriter) End() error {
+	return w.writer.Flush()
+}
+
+// csvRowWriter writes rows as CSV, with a header line carrying the column names
+type csvRowWriter struct {
+	writer *csv.Writer
+	buffer *bufio.Writer
+}
+
+func (w *csvRowWriter) Begin(columns []string) error {
+	return w.writer.Write(columns)
+}
+
+func (w *csvRowWriter) Row(_ []string, values []any) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formatDBValue(v)
+	}
+	return w.writer.Write(record)
+}
+
+func (w *csvRowWriter) End() error {
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		return err
+	}
+	return w.buffer.Flush()
+}
+
+// formatDBValue formats a value, as converted by toJSONValue, as plain text. NULL values become empty strings, and
+// arrays and JSON values are kept in their JSON form
+func formatDBValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.RawMessage:
+		return string(v)
+	case []any:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dbIdentifierRegexp is what table and column names must look like to be exposed as REST resources
+var dbIdentifierRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// dbRestOperators maps the operators clients can use in the filters to their SQL counterparts
+var dbRestOperators = map[string]string{"eq": "=", "neq": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<=", "like": "LIKE"}
+
+// DBRestConfig is the configuration of the REST resources exposed over database tables. The table is selected by the
+// "table" URL variable, and the row by the "id" URL variable
+// Tables is a map of table name=table configuration. Only these tables are exposed
+type DBRestConfig struct {
+	Tables map[string]*DBRestTable `yaml:"tables"`
+}
+
+// DBRestTable is the configuration of a table exposed as a REST resource
+// Key is the column identifying the rows. Defaults to "id"
+// Columns is the list of columns that can be read, filtered and written
+// Filters is a map of column=template. Only the rows matching all of them can be read, updated or deleted, and new
+// rows are created with these values. The templates are evaluated against the API transaction, as in ${Claims.sub}
+type DBRestTable struct {
+	Key     string    `yaml:"key"`
+	Columns []string  `yaml:"columns"`
+	Filters StringMap `yaml:"filters"`
+}
+
+// Init will validate the table and column names, and set the defaults
+func (c *DBRestConfig) Init() error {
+	if c == nil {
+		return nil
+	}
+	for name, table := range c.Tables {
+		if !dbIdentifierRegexp.MatchString(name) {
+			return errors.New("invalid table name: " + name)
+		}
+		if table.Key == "" {
+			table.Key = "id"
+		}
+		if len(table.Columns) == 0 {
+			return errors.New("no columns are allowed for table: " + name)
+		}
+		identifiers := append([]string{table.Key}, table.Columns...)
+		for column := range table.Filters {
+			identifiers = append(identifiers, column)
+		}
+		for _, identifier := range identifiers {
+			if !dbIdentifierRegexp.MatchString(identifier) {
+				return errors.New("invalid column name: " + identifier)
+			}
+		}
+	}
+	return nil
+}
+
+// HasColumn returns true if the column is in the allowlist
+func (t *DBRestTable) HasColumn(column string) bool {
+	return stringInArray(column, t.Columns)
+}
+
+// RowFilters evaluates the row-level filters against the API transaction. The second return value is false if any of
+// the filters cannot be resolved to a value, in which case no row is accessible
+func (t *DBRestTable) RowFilters(wrapper *APIWrapper) (map[string]any, bool, error) {
+	filters := make(map[string]any)
+	for column, filter := range t.Filters {
+		value, err := wrapper.Templ(wrapper.Context, filter)
+		if err != nil {
+			return nil, false, err
+		}
+		// expressions that cannot be resolved, such as claims in a request with no token, are left untouched
+		if value == "" || strings.Contains(value, "${") {
+			return nil, false, nil
+		}
+		filters[column] = value
+	}
+	return filters, true, nil
+}
+
+// dbRestStatement is a SQL statement under construction. The values are bound as named parameters
+type dbRestStatement struct {
+	driver string
+	where  []string
+	values map[string]any
+}
+
+// newDBRestStatement is the constructor for dbRestStatement
+func newDBRestStatement(driver string) *dbRestStatement {
+	return &dbRestStatement{driver: driver, where: make([]string, 0), values: make(map[string]any)}
+}
+
+// Quote quotes an identifier, based on the database driver
+func (s *dbRestStatement) Quote(identifier string) string {
+	if s.driver == "mysql" {
+		return "`" + identifier + "`"
+	}
+	return "\"" + identifier + "\""
+}
+
+// Bind adds a value to the bind values and returns its parameter reference
+func (s *dbRestStatement) Bind(value any) string {
+	name := "p" + strconv.Itoa(len(s.values))
+	s.values[name] = value
+	return ":" + name
+}
+
+// Where adds a condition to the WHERE clause
+func (s *dbRestStatement) Where(column string, operator string, value any) {
+	s.where = append(s.where, s.Quote(column)+" "+operator+" "+s.Bind(value))
+}
+
+// WhereClause composes the WHERE clause, if there are any conditions
+func (s *dbRestStatement) WhereClause() string {
+	if len(s.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(s.where, " AND ")
+}
+
+// selectColumns composes the list of the allowed columns, for a SELECT statement
+func (s *dbRestStatement) selectColumns(table *DBRestTable) string {
+	columns := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = s.Quote(column)
+	}
+	return strings.Join(columns, ", ")
+}
+
+// DBRestTrip will perform the request to a table exposed as REST resource and compose the http response
+func DBRestTrip(request *http.Request, wrapper *APIWrapper) (*http.Response, error) {
+	rule := wrapper.Rule
+	table, ok := rule.Database.Rest.Tables[wrapper.Request.UrlVars["table"]]
+	if !ok {
+		return statusResponse(request, http.StatusNotFound), nil
+	}
+	filters, ok, err := table.RowFilters(wrapper)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return statusResponse(request, http.StatusForbidden), nil
+	}
+	statement := newDBRestStatement(rule.db.DriverName())
+	id, hasID := wrapper.Request.UrlVars["id"]
+	if hasID {
+		statement.Where(table.Key, "=", id)
+	}
+	columns := make([]string, 0)
+	for column := range filters {
+		columns = append(columns, column)
+	}
+	// sorting the columns so that the statements are always the same
+	sort.Strings(columns)
+	for _, column := range columns {
+		statement.Where(column, "=", filters[column])
+	}
+	if rule.Database.IsReadOnly() && request.Method != http.MethodGet {
+		return statusResponse(request, http.StatusMethodNotAllowed), nil
+	}
+	switch {
+	case request.Method == http.MethodGet && hasID:
+		return dbRestRead(request, wrapper, table, statement)
+	case request.Method == http.MethodGet:
+		return dbRestList(request, wrapper, table, statement)
+	case request.Method == http.MethodPost && !hasID:
+		return dbRestInsert(request, wrapper, table, filters)
+	case request.Method == http.MethodPatch && hasID:
+		return dbRestUpdate(request, wrapper, table, statement, filters)
+	case request.Method == http.MethodDelete && hasID:
+		return dbRestExec(request, wrapper, "DELETE FROM "+statement.Quote(wrapper.Request.UrlVars["table"])+
+			statement.WhereClause(), statement.values)
+	}
+	return statusResponse(request, http.StatusMethodNotAllowed), nil
+}
+
+// dbRestRead reads a row and returns it as a JSON object
+func dbRestRead(request *http.Request, wrapper *APIWrapper, table *DBRestTable, statement *dbRestStatement) (*http.Response, error) {
+	ctx, session, cancel, err := wrapper.Rule.Database.Session(request.Context(), wrapper.Rule.db)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	query := "SELECT " + statement.selectColumns(table) + " FROM " + statement.Quote(wrapper.Request.UrlVars["table"]) +
+		statement.WhereClause()
+	rows, err := sqlx.NamedQueryContext(ctx, session, query, statement.values)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	row, err := readDBRow(rows.Rows, columnTypes)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return statusResponse(request, http.StatusNotFound), nil
+	}
+	data, err := json.Marshal(rowToMap(table.Columns, row))
+	if err != nil {
+		return nil, err
+	}
+	response := statusResponse(request, http.StatusOK)
+	response.Header.Set("content-type", dbFormatJSON)
+	response.Body = io.NopCloser(bytes.NewReader(data))
+	response.ContentLength = int64(len(data))
+	return response, nil
+}
+
+// dbRestList lists the rows matching the filters in the query parameters, and streams them
+func dbRestList(request *http.Request, wrapper *APIWrapper, table *DBRestTable, statement *dbRestStatement) (*http.Response, error) {
+	for param, values := range request.URL.Query() {
+		// parameters that are not allowed columns, such as the pagination parameters, are not filters
+		if !table.HasColumn(param) {
+			continue
+		}
+		for _, value := range values {
+			operator := "="
+			if prefix, operand, found := strings.Cut(value, "."); found && dbRestOperators[prefix] != "" {
+				operator = dbRestOperators[prefix]
+				value = operand
+			}
+			statement.Where(param, operator, value)
+		}
+	}
+	database := wrapper.Rule.Database
+	var page *dbPage
+	limitClause := ""
+	if database.Pagination != nil {
+		requestedPage := database.Pagination.RequestedPage(request.URL.Query())
+		requestedPage.key = table.Key
+		if database.Pagination.Mode == "keyset" {
+			if requestedPage.after != "" {
+				statement.Where(table.Key, ">", requestedPage.after)
+			}
+			limitClause = " LIMIT " + statement.Bind(requestedPage.limit)
+		} else {
+			limitClause = " LIMIT " + statement.Bind(requestedPage.limit) + " OFFSET " + statement.Bind(requestedPage.offset)
+		}
+		page = &requestedPage
+	}
+	query := "SELECT " + statement.selectColumns(table) + " FROM " + statement.Quote(wrapper.Request.UrlVars["table"]) +
+		statement.WhereClause() + " ORDER BY " + statement.Quote(table.Key) + limitClause
+	ctx, session, cancel, err := database.Session(request.Context(), wrapper.Rule.db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sqlx.NamedQueryContext(ctx, session, query, statement.values)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return streamDBRows(request, database, rows.Rows, page, cancel)
+}
+
+// dbRestBody returns the parsed request body as a map of column=value. The second return value is false if the body
+// is not an object, or if it contains columns that are not allowed
+func dbRestBody(wrapper *APIWrapper, table *DBRestTable) (map[string]any, bool) {
+	body, ok := wrapper.Request.ParsedBody.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	values := make(map[string]any)
+	for column, value := range body {
+		if !table.HasColumn(column) {
+			return nil, false
+		}
+		switch value.(type) {
+		case map[string]any, []any:
+			// objects and arrays are stored as JSON
+			data, _ := json.Marshal(value)
+			values[column] = string(data)
+		default:
+			values[column] = value
+		}
+	}
+	return values, true
+}
+
+// dbRestInsert inserts a row with the values in the request body. The row-level filters override the body values
+func dbRestInsert(request *http.Request, wrapper *APIWrapper, table *DBRestTable, filters map[string]any) (*http.Response, error) {
+	values, ok := dbRestBody(wrapper, table)
+	if !ok {
+		return statusResponse(request, http.StatusBadRequest), nil
+	}
+	for column, value := range filters {
+		values[column] = value
+	}
+	if len(values) == 0 {
+		return statusResponse(request, http.StatusBadRequest), nil
+	}
+	statement := newDBRestStatement(wrapper.Rule.db.DriverName())
+	columns := make([]string, 0)
+	for column := range values {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	quotedColumns := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = statement.Quote(column)
+		params[i] = statement.Bind(values[column])
+	}
+	response, err := dbRestExec(request, wrapper, "INSERT INTO "+statement.Quote(wrapper.Request.UrlVars["table"])+
+		" ("+strings.Join(quotedColumns, ", ")+") VALUES ("+strings.Join(params, ", ")+")", statement.values)
+	if err == nil && response.StatusCode == http.StatusNoContent {
+		response = statusResponse(request, http.StatusCreated)
+	}
+	return response, err
+}
+
+// dbRestUpdate updates a row with the values in the request body. The row-level filters cannot be changed
+func dbRestUpdate(request *http.Request, wrapper *APIWrapper, table *DBRestTable, statement *dbRestStatement, filters map[string]any) (*http.Response, error) {
+	values, ok := dbRestBody(wrapper, table)
+	if !ok {
+		return statusResponse(request, http.StatusBadRequest), nil
+	}
+	for column := range filters {
+		delete(values, column)
+	}
+	// the key identifies the row, and can't be changed
+	delete(values, table.Key)
+	if len(values) == 0 {
+		return statusResponse(request, http.StatusBadRequest), nil
+	}
+	columns := make([]string, 0)
+	for column := range values {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = statement.Quote(column) + " = " + statement.Bind(values[column])
+	}
+	return dbRestExec(request, wrapper, "UPDATE "+statement.Quote(wrapper.Request.UrlVars["table"])+" SET "+
+		strings.Join(assignments, ", ")+statement.WhereClause(), statement.values)
+}
+
+// dbRestExec executes a statement. The response is a 204, or a 404 if no row was affected
+func dbRestExec(request *http.Request, wrapper *APIWrapper, query string, values map[string]any) (*http.Response, error) {
+	ctx, session, cancel, err := wrapper.Rule.Database.Session(request.Context(), wrapper.Rule.db)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	result, err := sqlx.NamedExecContext(ctx, session, query, values)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return statusResponse(request, http.StatusNotFound), nil
+	}
+	return statusResponse(request, http.StatusNoContent), nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dbDateTimeLayouts are the layouts databases use when they return dates and times as text
+var dbDateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// toJSONValue converts a value, as returned by a database driver, into a value that faithfully represents it in JSON.
+// typeName is the database type name of the column, as returned by the driver
+func toJSONValue(typeName string, value any) any {
+	typeName = strings.ToUpper(typeName)
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		return formatDBTime(typeName, v)
+	case []byte:
+		return bytesToJSONValue(typeName, v)
+	case string:
+		return textToJSONValue(typeName, v)
+	case float64:
+		// JSON has no representation for these
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return v
+	case float32:
+		return toJSONValue(typeName, float64(v))
+	case int64:
+		// SQLite has no boolean storage class, booleans are stored as integers
+		if typeName == "BOOLEAN" || typeName == "BOOL" {
+			return v != 0
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// formatDBTime formats a time in RFC 3339. Dates with no time component are formatted as RFC 3339 full dates
+func formatDBTime(typeName string, value time.Time) string {
+	if typeName == "DATE" {
+		return value.Format("2006-01-02")
+	}
+	return value.Format(time.RFC3339Nano)
+}
+
+// bytesToJSONValue converts a raw value into a JSON value, based on the database type name
+func bytesToJSONValue(typeName string, value []byte) any {
+	switch {
+	case isDBBinaryType(typeName):
+		return base64.StdEncoding.EncodeToString(value)
+	case typeName == "BIT":
+		// MySQL bits are big endian unsigned integers
+		var res uint64
+		for _, b := range value {
+			res = res<<8 | uint64(b)
+		}
+		return res
+	case strings.HasPrefix(typeName, "_"):
+		// Postgres array type names are the element type names, prefixed with an underscore
+		return parsePGArray(string(value), typeName[1:])
+	default:
+		return textToJSONValue(typeName, string(value))
+	}
+}
+
+// textToJSONValue converts the text representation of a value into a JSON value, based on the database type name
+func textToJSONValue(typeName string, value string) any {
+	switch {
+	case typeName == "JSON" || typeName == "JSONB":
+		if json.Valid([]byte(value)) {
+			return json.RawMessage(value)
+		}
+	case isDBNumericType(typeName):
+		if _, err := strconv.ParseFloat(value, 64); err == nil && json.Valid([]byte(value)) {
+			return json.Number(value)
+		}
+	case typeName == "BOOL" || typeName == "BOOLEAN":
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	case typeName == "DATETIME" || typeName == "TIMESTAMP" || typeName == "TIMESTAMPTZ":
+		for _, layout := range dbDateTimeLayouts {
+			if parsed, err := time.Parse(layout, value); err == nil {
+				return formatDBTime(typeName, parsed)
+			}
+		}
+	}
+	return value
+}
+
+// isDBNumericType returns true if the database type name represents a number
+func isDBNumericType(typeName string) bool {
+	typeName = strings.TrimPrefix(typeName, "UNSIGNED ")
+	switch typeName {
+	case "INT", "INT2", "INT4", "INT8", "INTEGER", "TINYINT", "SMALLINT", "MEDIUMINT", "BIGINT", "YEAR",
+		"DECIMAL", "NUMERIC", "FLOAT", "FLOAT4", "FLOAT8", "DOUBLE", "REAL":
+		return true
+	}
+	return false
+}
+
+// isDBBinaryType returns true if the database type name represents binary data
+func isDBBinaryType(typeName string) bool {
+	switch typeName {
+	case "BYTEA", "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BINARY", "VARBINARY":
+		return true
+	}
+	return false
+}
+
+// parsePGArray parses a Postgres array literal, as in {1,2,NULL,"foo bar"}, into a JSON array. The elements are
+// converted based on the element type name. If the literal cannot be parsed, it's returned as a string
+func parsePGArray(data string, elemTypeName string) any {
+	parser := pgArrayParser{data: data, elemTypeName: elemTypeName}
+	res, ok := parser.parse()
+	if !ok || parser.pos != len(data) {
+		return data
+	}
+	return res
+}
+
+// pgArrayParser is a parser for Postgres array literals
+type pgArrayParser struct {
+	data         string
+	pos          int
+	elemTypeName string
+}
+
+// parse parses an array, starting at the current position. Nested arrays are parsed recursively
+func (p *pgArrayParser) parse() ([]any, bool) {
+	if p.pos >= len(p.data) || p.data[p.pos] != '{' {
+		return nil, false
+	}
+	p.pos++
+	res := make([]any, 0)
+	if p.pos < len(p.data) && p.data[p.pos] == '}' {
+		p.pos++
+		return res, true
+	}
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case '{':
+			nested, ok := p.parse()
+			if !ok {
+				return nil, false
+			}
+			res = append(res, nested)
+		case '"':
+			element, ok := p.parseQuoted()
+			if !ok {
+				return nil, false
+			}
+			res = append(res, textToJSONValue(p.elemTypeName, element))
+		default:
+			start := p.pos
+			for p.pos < len(p.data) && p.data[p.pos] != ',' && p.data[p.pos] != '}' {
+				p.pos++
+			}
+			element := p.data[start:p.pos]
+			if element == "NULL" {
+				res = append(res, nil)
+			} else {
+				res = append(res, textToJSONValue(p.elemTypeName, element))
+			}
+		}
+		if p.pos >= len(p.data) {
+			return nil, false
+		}
+		switch p.data[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return res, true
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// parseQuoted parses a quoted element, starting at the current position
+func (p *pgArrayParser) parseQuoted() (string, bool) {
+	p.pos++
+	var builder strings.Builder
+	for p.pos < len(p.data) && p.data[p.pos] != '"' {
+		if p.data[p.pos] == '\\' {
+			p.pos++
+		}
+		if p.pos < len(p.data) {
+			builder.WriteByte(p.data[p.pos])
+			p.pos++
+		}
+	}
+	if p.pos >= len(p.data) {
+		return "", false
+	}
+	p.pos++
+	return builder.String(), true
+}
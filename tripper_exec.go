@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExecConfig is the configuration of an exec origin
+// Args are the arguments of the executable. Arguments can be templates, evaluated against the transaction
+// AllowedArgs is a list of regular expressions. Templated arguments must fully match at least one of them
+// Env is a map of extra environment variables for the executable
+// Dir is the working directory of the executable. Defaults to the directory of the executable
+// Timeout is the maximum duration of the execution, as a duration string. Defaults to 30s
+// MaxConcurrency is the maximum number of concurrent executions. Requests exceeding it are rejected with a 503.
+// Zero means no limit
+// PassAuthorization passes the Authorization header to the executable as HTTP_AUTHORIZATION. As in CGI, it's
+// withheld by default
+// _path is the path to the executable
+// _templated marks the arguments that are templates
+// _allowedArgs is the compiled version of AllowedArgs
+// _timeout is the parsed version of Timeout
+// _slots is the semaphore capping the concurrent executions
+type ExecConfig struct {
+	Args              []string  `yaml:"args"`
+	AllowedArgs       []string  `yaml:"allowedArgs"`
+	Env               StringMap `yaml:"env"`
+	Dir               string    `yaml:"dir"`
+	Timeout           string    `yaml:"timeout"`
+	MaxConcurrency    int       `yaml:"maxConcurrency"`
+	PassAuthorization bool      `yaml:"passAuthorization"`
+	_path             string
+	_templated        []bool
+	_allowedArgs      []*regexp.Regexp
+	_timeout          time.Duration
+	_slots            chan bool
+}
+
+// Init will resolve the executable, compile the allowed arguments and set the defaults
+func (c *ExecConfig) Init(origin string) error {
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	// exec URIs are handled like file URIs, so exec://bin/report is a relative path
+	c._path = originURL.Host + originURL.Path
+	info, err := os.Stat(c._path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return errors.New("not an executable: " + c._path)
+	}
+	for _, allowed := range c.AllowedArgs {
+		rx, err := regexp.Compile("^(?:" + allowed + ")$")
+		if err != nil {
+			return err
+		}
+		c._allowedArgs = append(c._allowedArgs, rx)
+	}
+	if c.Dir == "" {
+		c.Dir = filepath.Dir(c._path)
+	}
+	c._templated = make([]bool, len(c.Args))
+	for i, arg := range c.Args {
+		if strings.Contains(arg, "${") {
+			if len(c._allowedArgs) == 0 {
+				return errors.New("templated exec arguments require allowedArgs: " + arg)
+			}
+			c._templated[i] = true
+		}
+	}
+	c._timeout = 30 * time.Second
+	if c.Timeout != "" {
+		if c._timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return err
+		}
+	}
+	if c.MaxConcurrency > 0 {
+		c._slots = make(chan bool, c.MaxConcurrency)
+	}
+	return nil
+}
+
+// IsAllowedArg returns true if the argument matches at least one of the allowed arguments
+func (c *ExecConfig) IsAllowedArg(arg string) bool {
+	for _, rx := range c._allowedArgs {
+		if rx.MatchString(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire reserves an execution slot. It returns false if the concurrency cap has been reached
+func (c *ExecConfig) acquire() bool {
+	if c._slots == nil {
+		return true
+	}
+	select {
+	case c._slots <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees an execution slot
+func (c *ExecConfig) release() {
+	if c._slots != nil {
+		<-c._slots
+	}
+}
+
+// ExecTrip will run the executable CGI-style. The request metadata is passed through environment variables and the
+// body on stdin. The output is parsed as headers, followed by the body, which streams as the executable writes it
+func ExecTrip(request *http.Request, wrapper *APIWrapper) (*http.Response, error) {
+	cfg := wrapper.Rule.Exec
+	args := make([]string, len(cfg.Args))
+	for i, arg := range cfg.Args {
+		if !cfg._templated[i] {
+			args[i] = arg
+			continue
+		}
+		value, err := wrapper.Templ(request.Context(), arg)
+		if err != nil || !cfg.IsAllowedArg(value) {
+			log.LogWithMeta("exec argument not allowed", wrapper, AnyMap{"arg": value}, log.Info)
+			return statusResponse(request, http.StatusBadRequest), nil
+		}
+		args[i] = value
+	}
+	if !cfg.acquire() {
+		return statusResponse(request, http.StatusServiceUnavailable), nil
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), cfg._timeout)
+	cmd := exec.CommandContext(ctx, cfg._path, args...)
+	cmd.Dir = cfg.Dir
+	cmd.Env = execEnv(request, wrapper)
+	if request.Body != nil {
+		cmd.Stdin = request.Body
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = startExec(cmd)
+	}
+	if err != nil {
+		cancel()
+		cfg.release()
+		return nil, err
+	}
+	// the children of the executable may keep the output open after it's been killed, so we stop reading on timeout
+	go func() {
+		<-ctx.Done()
+		_ = stdout.Close()
+	}()
+	body := &execBody{cmd: cmd, cancel: cancel, release: cfg.release}
+	reader := bufio.NewReader(stdout)
+	response, err := readCGIResponse(request, reader)
+	if err != nil {
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		_ = body.Close()
+		// if the transaction deadline is exceeded, the error is handled by the proxy
+		if ctxErr := request.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if timedOut {
+			log.Warn("executable timed out", nil, AnyMap{"path": cfg._path})
+			return statusResponse(request, http.StatusGatewayTimeout), nil
+		}
+		log.Warn("executable did not produce a valid response", err, AnyMap{"path": cfg._path})
+		return statusResponse(request, http.StatusBadGateway), nil
+	}
+	body.Reader = reader
+	response.Body = body
+	return response, nil
+}
+
+// execEnv composes the CGI environment variables for the request
+func execEnv(request *http.Request, wrapper *APIWrapper) []string {
+	cfg := wrapper.Rule.Exec
+	env := cgiVariables(request, wrapper)
+	env["SCRIPT_NAME"] = wrapper.Rule.StripPrefix
+	env["SCRIPT_FILENAME"] = cfg._path
+	env["PATH_INFO"] = strings.TrimPrefix(request.URL.Host+request.URL.Path, cfg._path)
+	env["PATH"] = os.Getenv("PATH")
+	// the credentials of the client are not the business of the executable, unless told otherwise
+	if !cfg.PassAuthorization {
+		delete(env, "HTTP_AUTHORIZATION")
+	}
+	for key, value := range cfg.Env {
+		env[key] = value
+	}
+	res := make([]string, 0, len(env))
+	for key, value := range env {
+		res = append(res, key+"="+value)
+	}
+	return res
+}
+
+// execBody is the body of the response of an executable. Closing it waits for the execution to end and frees its slot
+// eof is true if the whole output has been read. If not, the execution is terminated on close
+type execBody struct {
+	io.Reader
+	cmd     *exec.Cmd
+	cancel  context.CancelFunc
+	release func()
+	eof     bool
+	once    sync.Once
+}
+
+func (b *execBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *execBody) Close() error {
+	b.once.Do(func() {
+		if !b.eof {
+			b.cancel()
+		}
+		if err := b.cmd.Wait(); err != nil && b.eof {
+			log.Warn("executable failed", err, AnyMap{"path": b.cmd.Path})
+		}
+		b.cancel()
+		b.release()
+	})
+	return nil
+}
+
+// startExec starts the command, logging what it writes to stderr. The stderr pipe is handed to the process as a file,
+// so that waiting for the process does not depend on its children closing it
+func startExec(cmd *exec.Cmd) error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = writer
+	err = cmd.Start()
+	_ = writer.Close()
+	if err != nil {
+		_ = reader.Close()
+		return err
+	}
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			log.Warn("executable wrote to stderr", nil, AnyMap{"path": cmd.Path, "stderr": scanner.Text()})
+		}
+		_ = reader.Close()
+	}()
+	return nil
+}
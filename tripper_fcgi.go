@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types and roles, as in the FastCGI specification
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiMaxContent   = 65535
+	fcgiRequestID    = 1
+)
+
+// FCGIConfig is the configuration of a FastCGI origin
+// DocumentRoot is the document root of the FastCGI application, as seen by the application
+// Script is the script handling all the requests, relative to the document root, as in front controllers. If empty,
+// the script is the requested path
+// Index is the script to run when a directory is requested. Defaults to index.php
+// Params is a map of extra FastCGI parameters
+// Timeout is the maximum duration of the exchange with the application, as a duration string. Defaults to 30s
+// _network is either tcp or unix
+// _address is the address of the application
+// _originPath is the path of the origin, which is not part of the script path
+// _timeout is the parsed version of Timeout
+type FCGIConfig struct {
+	DocumentRoot string    `yaml:"documentRoot"`
+	Script       string    `yaml:"script"`
+	Index        string    `yaml:"index"`
+	Params       StringMap `yaml:"params"`
+	Timeout      string    `yaml:"timeout"`
+	_network     string
+	_address     string
+	_originPath  string
+	_timeout     time.Duration
+}
+
+// Init will parse the address of the application and set the defaults
+func (c *FCGIConfig) Init(origin string) error {
+	if c == nil {
+		return errors.New("FastCGI origin requires a FastCGI configuration")
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if originURL.Scheme == "fcgi+unix" {
+		// the whole path is the socket, so nothing in the request path belongs to the origin
+		c._network = "unix"
+		c._address = originURL.Host + originURL.Path
+		c._originPath = c._address
+	} else {
+		c._network = "tcp"
+		c._address = originURL.Host
+		c._originPath = originURL.Path
+	}
+	if c.DocumentRoot == "" {
+		return errors.New("FastCGI origin requires a documentRoot")
+	}
+	if c.Index == "" {
+		c.Index = "index.php"
+	}
+	c._timeout = 30 * time.Second
+	if c.Timeout != "" {
+		if c._timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FCGITrip will forward the request to the FastCGI application and stream its response back
+func FCGITrip(request *http.Request, wrapper *APIWrapper) (*http.Response, error) {
+	cfg := wrapper.Rule.FCGI
+	dialer := net.Dialer{Timeout: cfg._timeout}
+	conn, err := dialer.DialContext(request.Context(), cfg._network, cfg._address)
+	if err != nil {
+		if ctxErr := request.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		log.Warn("could not connect to the FastCGI application", err, AnyMap{"address": cfg._address})
+		return statusResponse(request, http.StatusBadGateway), nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(cfg._timeout))
+	body := &fcgiBody{conn: conn, reader: bufio.NewReader(conn), done: make(chan bool)}
+	// if the transaction deadline is exceeded, we drop the connection
+	go func() {
+		select {
+		case <-request.Context().Done():
+			_ = conn.Close()
+		case <-body.done:
+		}
+	}()
+	// the request is written while the response is read, as the application may respond before reading all the body.
+	// Write errors surface when reading, or as timeouts
+	go func() {
+		_ = writeFCGIRequest(conn, fcgiParamsFor(request, wrapper), request.Body)
+	}()
+	reader := bufio.NewReader(body)
+	response, err := readCGIResponse(request, reader)
+	if err != nil {
+		_ = body.Close()
+		if ctxErr := request.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			log.Warn("FastCGI application timed out", nil, AnyMap{"address": cfg._address})
+			return statusResponse(request, http.StatusGatewayTimeout), nil
+		}
+		log.Warn("FastCGI application did not produce a valid response", err, AnyMap{"address": cfg._address})
+		return statusResponse(request, http.StatusBadGateway), nil
+	}
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, body}
+	return response, nil
+}
+
+// fcgiParamsFor composes the FastCGI parameters for the request
+func fcgiParamsFor(request *http.Request, wrapper *APIWrapper) map[string]string {
+	cfg := wrapper.Rule.FCGI
+	requestPath := strings.TrimPrefix(request.URL.Path, cfg._originPath)
+	if !strings.HasPrefix(requestPath, "/") {
+		requestPath = "/" + requestPath
+	}
+	scriptName := path.Clean(requestPath)
+	pathInfo := ""
+	if cfg.Script != "" {
+		scriptName = path.Clean("/" + cfg.Script)
+		pathInfo = requestPath
+	} else if strings.HasSuffix(requestPath, "/") {
+		scriptName = path.Join(scriptName, cfg.Index)
+	}
+	requestURI := requestPath
+	if request.URL.RawQuery != "" {
+		requestURI += "?" + request.URL.RawQuery
+	}
+	params := cgiVariables(request, wrapper)
+	params["GATEWAY_INTERFACE"] = "FastCGI/1.0"
+	params["DOCUMENT_ROOT"] = cfg.DocumentRoot
+	params["SCRIPT_NAME"] = scriptName
+	params["SCRIPT_FILENAME"] = path.Join(cfg.DocumentRoot, scriptName)
+	params["PATH_INFO"] = pathInfo
+	params["REQUEST_URI"] = requestURI
+	params["DOCUMENT_URI"] = requestPath
+	params["HTTP_HOST"] = request.Host
+	for key, value := range cfg.Params {
+		params[key] = value
+	}
+	return params
+}
+
+// writeFCGIRequest writes a whole FastCGI request: the begin request record, the parameters and the body
+func writeFCGIRequest(writer io.Writer, params map[string]string, body io.Reader) error {
+	buffered := bufio.NewWriter(writer)
+	// the connection is not kept alive, so the flags are all zero
+	if err := writeFCGIRecord(buffered, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	encoded := bytes.Buffer{}
+	for key, value := range params {
+		writeFCGILength(&encoded, len(key))
+		writeFCGILength(&encoded, len(value))
+		encoded.WriteString(key)
+		encoded.WriteString(value)
+	}
+	if err := writeFCGIStream(buffered, fcgiParams, &encoded); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if body == nil {
+		body = bytes.NewReader([]byte{})
+	}
+	if err := writeFCGIStream(buffered, fcgiStdin, body); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// writeFCGIStream writes the content of a reader as a stream of records of the given type, terminated by an
+// empty record
+func writeFCGIStream(writer *bufio.Writer, recordType byte, reader io.Reader) error {
+	chunk := make([]byte, fcgiMaxContent)
+	for {
+		n, err := reader.Read(chunk)
+		if n > 0 {
+			if err := writeFCGIRecord(writer, recordType, chunk[:n]); err != nil {
+				return err
+			}
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return writeFCGIRecord(writer, recordType, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeFCGIRecord writes a single record. The content must not exceed fcgiMaxContent
+func writeFCGIRecord(writer io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{fcgiVersion, recordType, 0, fcgiRequestID, byte(len(content) >> 8), byte(len(content)), byte(padding), 0}
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := writer.Write(content); err != nil {
+		return err
+	}
+	_, err := writer.Write(make([]byte, padding))
+	return err
+}
+
+// writeFCGILength writes the length of a name or value of a parameter, in either one or four bytes
+func writeFCGILength(buffer *bytes.Buffer, length int) {
+	if length < 128 {
+		buffer.WriteByte(byte(length))
+		return
+	}
+	_ = binary.Write(buffer, binary.BigEndian, uint32(length)|1<<31)
+}
+
+// fcgiBody reads the content of the stdout records of a FastCGI response, until the end request record. The content of
+// the stderr records is logged
+// content is what's left of the current stdout record
+// padding is the padding of the current stdout record
+// ended is true once the end request record has been read
+// done is closed when the body gets closed
+type fcgiBody struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	content int
+	padding int
+	ended   bool
+	done    chan bool
+	once    sync.Once
+}
+
+func (b *fcgiBody) Read(p []byte) (int, error) {
+	for b.content == 0 {
+		if b.ended {
+			return 0, io.EOF
+		}
+		if err := b.nextRecord(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > b.content {
+		p = p[:b.content]
+	}
+	n, err := b.reader.Read(p)
+	b.content -= n
+	if b.content == 0 && err == nil {
+		_, err = b.reader.Discard(b.padding)
+	}
+	return n, err
+}
+
+// nextRecord reads records until a stdout record with some content, or the end of the request
+func (b *fcgiBody) nextRecord() error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(b.reader, header); err != nil {
+		return err
+	}
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	padding := int(header[6])
+	switch header[1] {
+	case fcgiStdout:
+		b.content = length
+		b.padding = padding
+		if length == 0 {
+			_, err := b.reader.Discard(padding)
+			return err
+		}
+		return nil
+	case fcgiStderr:
+		data := make([]byte, length+padding)
+		if _, err := io.ReadFull(b.reader, data); err != nil {
+			return err
+		}
+		if length > 0 {
+			log.Warn("FastCGI application wrote to stderr", nil, AnyMap{"stderr": strings.TrimSpace(string(data[:length]))})
+		}
+		return nil
+	case fcgiEndRequest:
+		b.ended = true
+		_, err := b.reader.Discard(length + padding)
+		return err
+	default:
+		_, err := b.reader.Discard(length + padding)
+		return err
+	}
+}
+
+func (b *fcgiBody) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+		_ = b.conn.Close()
+	})
+	return nil
+}
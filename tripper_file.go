@@ -2,42 +2,206 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"html"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-// loadFile loads a file (to be used as an upstream server instead of HTTP)
-func loadFile(path *url.URL) ([]byte, error) {
-	return os.ReadFile(path.Host + path.Path)
+// FileConfig is the configuration of a file origin
+// Index is a list of file names to look for when a directory is requested
+// Listing if set to true, will produce a listing of the directory when no index file is found
+type FileConfig struct {
+	Index   []string `yaml:"index"`
+	Listing bool     `yaml:"listing"`
 }
 
-// getCT brutal, minimalistic content type detection
-func getCT(body []byte, fn string) string {
-	ct := http.DetectContentType(body)
-	if strings.HasPrefix(ct, "text/plain") {
-		if strings.HasSuffix(fn, ".json") {
-			return strings.Replace(ct, "text/plain", "application/json", 1)
+// pipeResponseWriter is an http.ResponseWriter that streams what's written to it into a pipe, so that a handler
+// can be turned into an http.Response without buffering the body
+// ready is closed as soon as the status code is known
+type pipeResponseWriter struct {
+	header http.Header
+	status int
+	pipe   *io.PipeWriter
+	ready  chan bool
+	once   sync.Once
+}
+
+// newPipeResponseWriter is the constructor for pipeResponseWriter
+func newPipeResponseWriter(pipe *io.PipeWriter) *pipeResponseWriter {
+	return &pipeResponseWriter{header: http.Header{}, pipe: pipe, ready: make(chan bool)}
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(statusCode int) {
+	w.once.Do(func() {
+		w.status = statusCode
+		close(w.ready)
+	})
+}
+
+func (w *pipeResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pipe.Write(data)
+}
+
+// serveAsResponse runs the provided handler in a separate goroutine and returns the http.Response it produces. The
+// body of the response streams what the handler writes
+func serveAsResponse(request *http.Request, handler func(writer http.ResponseWriter)) *http.Response {
+	reader, pipe := io.Pipe()
+	writer := newPipeResponseWriter(pipe)
+	go func() {
+		handler(writer)
+		// if the handler never wrote anything, the status is a 200
+		writer.WriteHeader(http.StatusOK)
+		_ = pipe.Close()
+	}()
+	<-writer.ready
+	response := http.Response{StatusCode: writer.status, Status: fmt.Sprintf("%d %s", writer.status, http.StatusText(writer.status)),
+		Request: request, Uncompressed: true, Header: writer.header, Body: reader, ContentLength: -1}
+	if contentLength, err := strconv.ParseInt(writer.header.Get("content-length"), 10, 64); err == nil {
+		response.ContentLength = contentLength
+	}
+	return &response
+}
+
+// statusResponse produces an empty response with the given status code
+func statusResponse(request *http.Request, statusCode int) *http.Response {
+	return &http.Response{StatusCode: statusCode, Status: fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Request: request, Uncompressed: true, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader([]byte{}))}
+}
+
+// resolveFilePath will resolve the file path requested by the provided URL, making sure it does not escape the root
+// directory set by the origin. The second return value is false if the path is outside the root
+func resolveFilePath(requestURL *url.URL, origin string) (string, bool) {
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return "", false
+	}
+	root := filepath.Clean(originURL.Host + originURL.Path)
+	target := filepath.Clean(requestURL.Host + requestURL.Path)
+	if !isWithin(root, target) {
+		return "", false
+	}
+	// symbolic links are not allowed to escape the root either
+	if resolvedRoot, err := filepath.EvalSymlinks(root); err == nil {
+		if resolvedTarget, err := filepath.EvalSymlinks(target); err == nil && !isWithin(resolvedRoot, resolvedTarget) {
+			return "", false
 		}
-		if strings.HasSuffix(fn, ".xml") {
-			return strings.Replace(ct, "text/plain", "text/xml", 1)
+	}
+	return target, true
+}
+
+// isWithin returns true if the target path is the root path or one of its descendants
+func isWithin(root string, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// FileTrip will receive a request, load a local file based on the information and produce a response.
+// The file is streamed, and range and conditional requests are supported
+func FileTrip(request *http.Request, rule *Rule) (*http.Response, error) {
+	if err := request.Context().Err(); err != nil {
+		return nil, err
+	}
+	filePath, ok := resolveFilePath(request.URL, rule.Origin)
+	if !ok {
+		return statusResponse(request, http.StatusForbidden), nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fileErrorResponse(request, err)
+	}
+	if info.IsDir() {
+		fileConfig := rule.File
+		if fileConfig == nil {
+			fileConfig = &FileConfig{}
+		}
+		// looking for index files first
+		for _, index := range fileConfig.Index {
+			// the index files are not allowed to escape the root either
+			indexPath, ok := resolveFilePath(&url.URL{Path: filepath.Join(filePath, index)}, rule.Origin)
+			if !ok {
+				return statusResponse(request, http.StatusForbidden), nil
+			}
+			indexInfo, err := os.Stat(indexPath)
+			if err == nil && !indexInfo.IsDir() {
+				return serveFile(request, indexPath, indexInfo)
+			}
 		}
+		if fileConfig.Listing {
+			return listDirectory(request, filePath)
+		}
+		return statusResponse(request, http.StatusNotFound), nil
+	}
+	return serveFile(request, filePath, info)
+}
+
+// fileErrorResponse converts file system errors into responses, when possible
+func fileErrorResponse(request *http.Request, err error) (*http.Response, error) {
+	if os.IsNotExist(err) {
+		return statusResponse(request, http.StatusNotFound), nil
+	}
+	if os.IsPermission(err) {
+		return statusResponse(request, http.StatusForbidden), nil
 	}
-	return ct
+	return nil, err
 }
 
-// FileTrip will receive a request, load a local file based on the information and produce a response
-func FileTrip(request *http.Request) (*http.Response, error) {
-	response := http.Response{StatusCode: 200, Request: request, Uncompressed: true}
-	response.Header = http.Header{}
+// serveFile streams the file at the provided path. Content type, ranges, ETag and Last-Modified based conditional
+// requests are handled by http.ServeContent
+func serveFile(request *http.Request, filePath string, info os.FileInfo) (*http.Response, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fileErrorResponse(request, err)
+	}
+	return serveAsResponse(request, func(writer http.ResponseWriter) {
+		defer func() {
+			_ = file.Close()
+		}()
+		writer.Header().Set("etag", fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+		http.ServeContent(writer, request, info.Name(), info.ModTime(), file)
+	}), nil
+}
 
-	body, err := loadFile(request.URL)
+// listDirectory produces an HTML listing of the directory at the provided path
+func listDirectory(request *http.Request, dirPath string) (*http.Response, error) {
+	entries, err := os.ReadDir(dirPath)
 	if err != nil {
-		return nil, err
+		return fileErrorResponse(request, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	// links need to be relative to the directory, which is not the case if the path does not end with a slash
+	prefix := ""
+	if !strings.HasSuffix(request.URL.Path, "/") {
+		prefix = path.Base(request.URL.Path) + "/"
+	}
+	body := bytes.NewBufferString("<pre>\n")
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		link := url.URL{Path: prefix + name}
+		body.WriteString("<a href=\"" + link.String() + "\">" + html.EscapeString(name) + "</a>\n")
 	}
-	response.Header.Set("content-type", getCT(body, request.URL.Path))
-	response.Body = io.NopCloser(bytes.NewReader(body))
-	return &response, nil
+	body.WriteString("</pre>\n")
+	response := statusResponse(request, http.StatusOK)
+	response.Header.Set("content-type", "text/html; charset=utf-8")
+	response.ContentLength = int64(body.Len())
+	response.Body = io.NopCloser(body)
+	return response, nil
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// grpcMetadataHeaderPrefix is the prefix of the HTTP headers carrying gRPC metadata, in both directions
+const grpcMetadataHeaderPrefix = "Grpc-Metadata-"
+
+// grpcHTTPStatuses maps the gRPC status codes to HTTP statuses
+var grpcHTTPStatuses = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+}
+
+// GRPCConfig is the configuration of a gRPC origin
+// DescriptorSet is the path to a protobuf descriptor set describing the services, as produced by
+// protoc --include_imports --descriptor_set_out
+// Methods is a map of HTTP method=gRPC method, where the gRPC method is in the package.Service/Method form
+// _conn is the connection to the gRPC server
+// _methods is a map of HTTP method=gRPC method descriptor
+type GRPCConfig struct {
+	DescriptorSet string            `yaml:"descriptorSet"`
+	Methods       map[string]string `yaml:"methods"`
+	_conn         *grpc.ClientConn
+	_methods      map[string]protoreflect.MethodDescriptor
+}
+
+// Init will load the descriptor set, resolve the methods and connect to the gRPC server
+func (c *GRPCConfig) Init(origin string) error {
+	if c == nil {
+		return errors.New("gRPC origin requires a gRPC configuration")
+	}
+	data, err := os.ReadFile(c.DescriptorSet)
+	if err != nil {
+		return err
+	}
+	descriptorSet := descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(data, &descriptorSet); err != nil {
+		return err
+	}
+	files, err := protodesc.NewFiles(&descriptorSet)
+	if err != nil {
+		return err
+	}
+	c._methods = make(map[string]protoreflect.MethodDescriptor)
+	for httpMethod, grpcMethod := range c.Methods {
+		serviceName, methodName, found := strings.Cut(grpcMethod, "/")
+		if !found {
+			return errors.New("gRPC methods need to be in the package.Service/Method form: " + grpcMethod)
+		}
+		descriptor, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+		if err != nil {
+			return err
+		}
+		service, ok := descriptor.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return errors.New("not a gRPC service: " + serviceName)
+		}
+		method := service.Methods().ByName(protoreflect.Name(methodName))
+		if method == nil {
+			return errors.New("gRPC method not found: " + grpcMethod)
+		}
+		if method.IsStreamingClient() || method.IsStreamingServer() {
+			return errors.New("streaming gRPC methods are not supported: " + grpcMethod)
+		}
+		c._methods[strings.ToLower(httpMethod)] = method
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	transportCredentials := insecure.NewCredentials()
+	if originURL.Scheme == "grpcs" {
+		transportCredentials = credentials.NewTLS(&tls.Config{})
+	}
+	// the connection is established lazily, so the server does not need to be up at startup
+	c._conn, err = grpc.Dial(originURL.Host, grpc.WithTransportCredentials(transportCredentials))
+	return err
+}
+
+// FindMethod returns the gRPC method for the provided HTTP method, or nil if none is configured
+func (c *GRPCConfig) FindMethod(httpMethod string) protoreflect.MethodDescriptor {
+	if c == nil {
+		return nil
+	}
+	return c._methods[strings.ToLower(httpMethod)]
+}
+
+// GRPCTrip will transcode the request into a gRPC request, invoke the gRPC method and transcode the response
+// into JSON
+func GRPCTrip(request *http.Request, wrapper *APIWrapper) (*http.Response, error) {
+	method := wrapper.Rule.GRPC.FindMethod(request.Method)
+	if method == nil {
+		return statusResponse(request, http.StatusMethodNotAllowed), nil
+	}
+	input := dynamicpb.NewMessage(method.Input())
+	if err := grpcRequestMessage(request, wrapper, input); err != nil {
+		return grpcErrorResponse(request, status.New(codes.InvalidArgument, err.Error()), nil), nil
+	}
+	ctx := metadata.NewOutgoingContext(request.Context(), grpcRequestMetadata(request.Header))
+	output := dynamicpb.NewMessage(method.Output())
+	var header, trailer metadata.MD
+	fullMethod := "/" + string(method.Parent().FullName()) + "/" + string(method.Name())
+	err := wrapper.Rule.GRPC._conn.Invoke(ctx, fullMethod, input, output, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		// if the transaction deadline is exceeded, the error is handled by the proxy
+		if ctxErr := request.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return grpcErrorResponse(request, status.Convert(err), header), nil
+	}
+	data, err := protojson.Marshal(output)
+	if err != nil {
+		return nil, err
+	}
+	response := statusResponse(request, http.StatusOK)
+	grpcResponseHeaders(response.Header, header)
+	response.Header.Set("content-type", "application/json")
+	response.Body = io.NopCloser(bytes.NewReader(data))
+	response.ContentLength = int64(len(data))
+	return response, nil
+}
+
+// grpcRequestMessage fills the gRPC request message with the JSON request body and the URL variables. URL variables
+// are matched to the fields by name
+func grpcRequestMessage(request *http.Request, wrapper *APIWrapper, message *dynamicpb.Message) error {
+	if request.Body != nil {
+		data, err := io.ReadAll(request.Body)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err = protojson.Unmarshal(data, message); err != nil {
+				return err
+			}
+		}
+	}
+	fields := message.Descriptor().Fields()
+	for name, value := range wrapper.Request.UrlVars {
+		field := fields.ByName(protoreflect.Name(name))
+		if field == nil {
+			field = fields.ByJSONName(name)
+		}
+		if field == nil {
+			continue
+		}
+		fieldValue, err := parseGRPCFieldValue(field, value)
+		if err != nil {
+			return err
+		}
+		message.Set(field, fieldValue)
+	}
+	return nil
+}
+
+// parseGRPCFieldValue converts a string into the value of a scalar field
+func parseGRPCFieldValue(field protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	if field.IsList() || field.IsMap() {
+		return protoreflect.Value{}, errors.New("field cannot be set from a URL variable: " + string(field.Name()))
+	}
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(value)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(value, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(value, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(value, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(value, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(value)
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByName(protoreflect.Name(value)); enumValue != nil {
+			return protoreflect.ValueOfEnum(enumValue.Number()), nil
+		}
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	}
+	return protoreflect.Value{}, errors.New("field cannot be set from a URL variable: " + string(field.Name()))
+}
+
+// grpcRequestMetadata composes the gRPC metadata from the request headers. The Authorization header is forwarded, as
+// well as the headers prefixed by Grpc-Metadata-, minus the prefix
+func grpcRequestMetadata(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range header {
+		key = http.CanonicalHeaderKey(key)
+		if key == "Authorization" {
+			md.Append("authorization", values...)
+		} else if strings.HasPrefix(key, grpcMetadataHeaderPrefix) {
+			md.Append(strings.TrimPrefix(key, grpcMetadataHeaderPrefix), values...)
+		}
+	}
+	return md
+}
+
+// grpcResponseHeaders adds the gRPC response metadata to the response headers, prefixed by Grpc-Metadata-
+func grpcResponseHeaders(header http.Header, md metadata.MD) {
+	for key, values := range md {
+		// binary metadata does not belong in HTTP headers
+		if strings.HasSuffix(key, "-bin") {
+			continue
+		}
+		for _, value := range values {
+			header.Add(grpcMetadataHeaderPrefix+key, value)
+		}
+	}
+}
+
+// grpcErrorResponse composes a JSON response out of a gRPC status, mapping the code to an HTTP status
+func grpcErrorResponse(request *http.Request, st *status.Status, md metadata.MD) *http.Response {
+	httpStatus, ok := grpcHTTPStatuses[st.Code()]
+	if !ok {
+		httpStatus = http.StatusInternalServerError
+	}
+	data, _ := json.Marshal(AnyMap{"code": st.Code(), "message": st.Message()})
+	response := statusResponse(request, httpStatus)
+	grpcResponseHeaders(response.Header, md)
+	response.Header.Set("content-type", "application/json")
+	response.Body = io.NopCloser(bytes.NewReader(data))
+	response.ContentLength = int64(len(data))
+	return response
+}
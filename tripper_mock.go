@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/theirish81/gowalker"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// MockConfig is the configuration of a mock origin
+// Responses is a list of response variants. The first variant whose conditions match the request is used
+type MockConfig struct {
+	Responses []*MockResponse `yaml:"responses"`
+}
+
+// MockResponse is a response variant of a mock origin
+// When is the set of conditions for this variant to be selected. Leave empty for "always"
+// Status is the status code of the response. Defaults to 200
+// Headers is a map of response headers. The values can be templates
+// Body is the template of the response body
+// Template is the path to the template of the response body. The other files in the same directory are loaded as
+// sub-templates
+// _subTemplates are the sub-templates loaded alongside Template
+type MockResponse struct {
+	When          MockCondition `yaml:"when"`
+	Status        int           `yaml:"status"`
+	Headers       StringMap     `yaml:"headers"`
+	Body          string        `yaml:"body"`
+	Template      string        `yaml:"template"`
+	_subTemplates gowalker.SubTemplates
+}
+
+// MockCondition is the set of conditions for a mock response variant to be selected
+// Method is the request method
+// UrlVars is a map of URL variable name=regexp. All of them must match
+// Query is a map of query parameter name=regexp. All of them must match
+// _urlVars is the compiled version of UrlVars
+// _query is the compiled version of Query
+type MockCondition struct {
+	Method   string    `yaml:"method"`
+	UrlVars  StringMap `yaml:"urlVars"`
+	Query    StringMap `yaml:"query"`
+	_urlVars map[string]*regexp.Regexp
+	_query   map[string]*regexp.Regexp
+}
+
+// Init will load the templates and compile the conditions
+func (c *MockConfig) Init() error {
+	if c == nil {
+		return errors.New("mock origin requires a mock configuration")
+	}
+	for _, response := range c.Responses {
+		var err error
+		if response.Status == 0 {
+			response.Status = 200
+		}
+		if response.Template != "" {
+			response.Body, response._subTemplates, err = loadTemplateWithSub(response.Template)
+			if err != nil {
+				return err
+			}
+		}
+		response.When._urlVars, err = compileRegexpMap(response.When.UrlVars)
+		if err != nil {
+			return err
+		}
+		response.When._query, err = compileRegexpMap(response.When.Query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select will return the first response variant whose conditions match the transaction, or nil if none does
+func (c *MockConfig) Select(wrapper *APIWrapper) *MockResponse {
+	for _, response := range c.Responses {
+		if response.When.matches(wrapper) {
+			return response
+		}
+	}
+	return nil
+}
+
+// matches returns true if the transaction matches all the conditions
+func (c *MockCondition) matches(wrapper *APIWrapper) bool {
+	if c.Method != "" && !strings.EqualFold(c.Method, wrapper.Request.Method) {
+		return false
+	}
+	for name, rx := range c._urlVars {
+		if !rx.MatchString(wrapper.Request.UrlVars[name]) {
+			return false
+		}
+	}
+	query := wrapper.Request.URL.Query()
+	for name, rx := range c._query {
+		if !rx.MatchString(query.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MockTrip will compose a response based on the mock configuration of the rule, rendering the templates against the
+// transaction. If no response variant matches, a 404 is returned
+func MockTrip(request *http.Request, wrapper *APIWrapper) (*http.Response, error) {
+	response := http.Response{StatusCode: 404, Request: request, Uncompressed: true}
+	response.Header = http.Header{}
+	mockResponse := wrapper.Rule.Mock.Select(wrapper)
+	if mockResponse == nil {
+		response.Body = io.NopCloser(bytes.NewReader([]byte{}))
+		return &response, nil
+	}
+	for k, v := range mockResponse.Headers {
+		value, err := wrapper.Templ(wrapper.Context, v)
+		if err != nil {
+			return nil, err
+		}
+		response.Header.Set(k, value)
+	}
+	body, err := template.TemplWithSub(wrapper.Context, mockResponse.Body, mockResponse._subTemplates, wrapper)
+	if err != nil {
+		return nil, err
+	}
+	response.StatusCode = mockResponse.Status
+	response.Status = fmt.Sprintf("%d %s", mockResponse.Status, http.StatusText(mockResponse.Status))
+	response.Body = io.NopCloser(bytes.NewReader([]byte(body)))
+	return &response, nil
+}
@@ -2,39 +2,221 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/koding/websocketproxy"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 )
 
+// WSConfig is the configuration of the message pipelines of a websocket origin
+// Inbound is the pipeline of the messages sent by the client to the origin
+// Outbound is the pipeline of the messages sent by the origin to the client
+// CloseOnReject, if true, closes the connection with a policy violation when a transformer rejects a message.
+// Otherwise, rejected messages are dropped
+type WSConfig struct {
+	Inbound       WSPipelineConfig `yaml:"inbound"`
+	Outbound      WSPipelineConfig `yaml:"outbound"`
+	CloseOnReject bool             `yaml:"closeOnReject"`
+}
+
+// WSPipelineConfig is the configuration of the pipeline of the messages travelling in one direction
+// MaxMessageSize is the maximum size of a message, in bytes. Larger messages close the connection. Zero means no limit
+// Transformers are the transformers of the messages
+// Sidecars are the sidecars receiving the messages
+// _transformers are the initialized transformers
+// _sidecars are the initialized sidecars
+type WSPipelineConfig struct {
+	MaxMessageSize int64               `yaml:"maxMessageSize"`
+	Transformers   []TransformerConfig `yaml:"transformers"`
+	Sidecars       []SidecarConfig     `yaml:"sidecars"`
+	_transformers  *WSTransformers
+	_sidecars      *WSSidecars
+}
+
+// Init initializes the transformers and the sidecars of both pipelines
+func (c *WSConfig) Init() error {
+	for _, pipeline := range []*WSPipelineConfig{&c.Inbound, &c.Outbound} {
+		var err error
+		if pipeline._transformers, err = NewWSTransformers(pipeline.Transformers); err != nil {
+			return err
+		}
+		pipeline._sidecars = NewWSSidecars(pipeline.Sidecars)
+	}
+	return nil
+}
+
+// WSConnection is a websocket connection proxied through a message pipeline
+// ID is the ID of the transaction that opened the connection
+// Wrapper is a clone of the wrapper of the transaction that opened the connection
+// Start is when the connection was established
+// state holds the per-connection state of the transformers
+type WSConnection struct {
+	ID      string
+	Wrapper *APIWrapper
+	Start   time.Time
+	state   sync.Map
+}
+
+// WSMessage is a message travelling in a websocket connection
+// Connection is the connection the message belongs to
+// Direction is either "inbound", from the client to the origin, or "outbound", from the origin to the client
+// Type is the websocket message type, either websocket.TextMessage or websocket.BinaryMessage
+// Data is the content of the message
+// Time is when the message was received
+type WSMessage struct {
+	Connection *WSConnection
+	Direction  string
+	Type       int
+	Data       []byte
+	Time       time.Time
+}
+
+// TypeName returns the type of the message as either "text" or "binary"
+func (m *WSMessage) TypeName() string {
+	if m.Type == websocket.BinaryMessage {
+		return "binary"
+	}
+	return "text"
+}
+
 // WSTripper is the tripper for websocket requests
-func WSTripper(request *http.Request, _ *Rule) (*http.Response, error) {
+func WSTripper(request *http.Request, rule *Rule) (*http.Response, error) {
+	wrapper := GetWrapper(request)
+	// if the rule has a message pipeline, we proxy the messages ourselves
+	if rule.WebSocket != nil {
+		return wsPipelineTrip(request, wrapper)
+	}
 	// create a new websocket proxy for the provided URL
 	socket := websocketproxy.NewProxy(request.URL)
-	// set a timeout to the connection. It is the same as the Upstream.Timeout
-	timeout, _ := time.ParseDuration(config.Network.Upstream.Timeout)
-	socket.Dialer = &websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: timeout,
-	}
+	socket.Dialer = wsDialer()
 	// During upgrades, we need to make sure a certain set of incoming headers are not overwritten
 	socket.Director = func(incoming *http.Request, out http.Header) {
-		for k, v := range incoming.Header {
-			switch k {
-			case "Sec-Websocket-Key", "Connection", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Upgrade":
-			default:
-				out.Set(k, v[0])
-			}
+		for k, v := range wsRequestHeader(incoming.Header) {
+			out[k] = v
 		}
 	}
-	wrapper := GetWrapper(request)
 
-	// setting the connection as "hijacked". No further writes are possible in this response
+	// setting the connection as "hijacked". No further writes are possible in this response, and the connection is
+	// meant to outlive the transaction deadline
 	wrapper.Hijacked = true
+	wrapper.LiftDeadline()
 
 	socket.ServeHTTP(wrapper.ResponseWriter, request)
 	response := http.Response{StatusCode: 200, Request: request, Body: io.NopCloser(bytes.NewReader([]byte{}))}
 	return &response, nil
 }
+
+// wsDialer returns the dialer for the origin. The handshake timeout is the same as the Upstream.Timeout
+func wsDialer() *websocket.Dialer {
+	timeout, _ := time.ParseDuration(config.Network.Upstream.Timeout)
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: timeout,
+	}
+}
+
+// wsRequestHeader returns the headers to send to the origin, minus the ones the dialer sets during the upgrade
+func wsRequestHeader(incoming http.Header) http.Header {
+	out := http.Header{}
+	for k, v := range incoming {
+		switch k {
+		case "Sec-Websocket-Key", "Connection", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Upgrade":
+		default:
+			out.Set(k, v[0])
+		}
+	}
+	return out
+}
+
+// wsPipelineTrip connects to the origin, upgrades the client connection and runs every message through the pipeline
+// of its direction
+func wsPipelineTrip(request *http.Request, wrapper *APIWrapper) (*http.Response, error) {
+	backend, backendResponse, err := wsDialer().DialContext(request.Context(), request.URL.String(), wsRequestHeader(request.Header))
+	if err != nil {
+		log.Warn("could not connect to the websocket origin", err, AnyMap{"origin": request.URL.String()})
+		return statusResponse(request, http.StatusBadGateway), nil
+	}
+	defer func() {
+		_ = backend.Close()
+	}()
+	// the sub-protocol chosen by the origin and its cookies are passed to the client
+	upgradeHeader := http.Header{}
+	if protocol := backendResponse.Header.Get("Sec-Websocket-Protocol"); protocol != "" {
+		upgradeHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+	for _, cookie := range backendResponse.Header.Values("Set-Cookie") {
+		upgradeHeader.Add("Set-Cookie", cookie)
+	}
+
+	// setting the connection as "hijacked". No further writes are possible in this response, and the connection is
+	// meant to outlive the transaction deadline
+	wrapper.Hijacked = true
+	wrapper.LiftDeadline()
+	response := http.Response{StatusCode: 200, Request: request, Body: io.NopCloser(bytes.NewReader([]byte{}))}
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	client, err := upgrader.Upgrade(wrapper.ResponseWriter, request, upgradeHeader)
+	if err != nil {
+		// the upgrader has already replied to the client
+		log.Warn("could not upgrade the websocket connection", err, AnyMap{"origin": request.URL.String()})
+		return &response, nil
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	connection := &WSConnection{ID: wrapper.ID, Wrapper: wrapper.Clone(), Start: time.Now()}
+	cfg := wrapper.Rule.WebSocket
+	// when either side stops, the connections are closed and the other side stops as well
+	done := make(chan error, 2)
+	go connection.pump(client, backend, "inbound", &cfg.Inbound, cfg.CloseOnReject, done)
+	go connection.pump(backend, client, "outbound", &cfg.Outbound, cfg.CloseOnReject, done)
+	<-done
+	return &response, nil
+}
+
+// pump reads the messages from src, runs them through the pipeline and writes them to dst, until either side fails
+// or closes the connection
+func (c *WSConnection) pump(src *websocket.Conn, dst *websocket.Conn, direction string, pipeline *WSPipelineConfig, closeOnReject bool, done chan error) {
+	if pipeline.MaxMessageSize > 0 {
+		src.SetReadLimit(pipeline.MaxMessageSize)
+	}
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			_ = dst.WriteControl(websocket.CloseMessage, wsCloseMessage(err), time.Now().Add(time.Second))
+			done <- err
+			return
+		}
+		message := &WSMessage{Connection: c, Direction: direction, Type: messageType, Data: data, Time: time.Now()}
+		if message, err = pipeline._transformers.Transform(message); err != nil {
+			if closeOnReject {
+				closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "message rejected")
+				_ = src.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+				_ = dst.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+				done <- err
+				return
+			}
+			continue
+		}
+		pipeline._sidecars.Run(message)
+		if err = dst.WriteMessage(message.Type, message.Data); err != nil {
+			done <- err
+			return
+		}
+	}
+}
+
+// wsCloseMessage composes the close message to forward to the other side, based on the error that stopped the reads
+func wsCloseMessage(err error) []byte {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure && closeErr.Code != websocket.CloseTLSHandshake {
+		return websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+	}
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+}
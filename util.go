@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"io"
 	"os"
 	"reflect"
 	"strings"
@@ -109,3 +111,23 @@ func IsGZIPHeader(transferEncoding []string) bool {
 	}
 	return false
 }
+
+// readAtMost reads the provided stream up to `max` bytes. If the stream is longer than that, the returned boolean is
+// true, and the returned bytes are just the portion of the stream that has been consumed. A `max` of zero or less
+// means there's no limit
+func readAtMost(reader io.Reader, max int64) ([]byte, bool, error) {
+	if max <= 0 {
+		data, err := io.ReadAll(reader)
+		return data, false, err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, max+1))
+	return data, int64(len(data)) > max, err
+}
+
+// rewindBody puts a consumed portion of a body back in front of the rest of the stream
+func rewindBody(consumed []byte, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(consumed), body), body}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -53,6 +54,26 @@ func (r *APIRequest) Clone(ctx context.Context) *APIRequest {
 	return &APIRequest{r.Request.Clone(ctx), r.ExpandedBody, r.ParsedBody, r.UrlVars}
 }
 
+// SetBody replaces the body of the request
+func (r *APIRequest) SetBody(data []byte) {
+	r.ExpandedBody = data
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.Header.Del("content-length")
+}
+
+// SetBody replaces the body of the response. The new body is never compressed
+func (r *APIResponse) SetBody(data []byte) {
+	r.Header.Del("content-length")
+	r.Header.Del("transfer-encoding")
+	r.Header.Del("content-encoding")
+	r.TransferEncoding = make([]string, 0)
+	r.Uncompressed = true
+	r.ExpandedBody = data
+	r.ContentLength = int64(len(data))
+	r.Body = io.NopCloser(bytes.NewReader(data))
+}
+
 // APIWrapper wraps a Request and a response
 type APIWrapper struct {
 	ID             string
@@ -69,6 +90,12 @@ type APIWrapper struct {
 	RealIP         string
 	Tags           []string
 	ApplyHeaders   http.Header
+	// Variant is the name of the traffic split variant serving the transaction, if the rule splits the traffic
+	Variant string
+	// cancel releases the resources associated to the rule timeout, if any
+	cancel context.CancelFunc
+	// deadline cancels the context when the rule timeout is exceeded, if any
+	deadline *time.Timer
 	// When set to true, it means that the connection has been hijacked. This is the case when websockets
 	// are involved
 	Hijacked bool
@@ -77,19 +104,27 @@ type APIWrapper struct {
 // Clone will do sort of a somewhat shallow clone of the wrapper. This is useful when sending the wrapper is being
 // sent to a sidecar but also transformers apply. If we didn't clone, results may vary on timing
 func (w *APIWrapper) Clone() *APIWrapper {
-	return &APIWrapper{ID: w.ID, Context: w.Context, Request: w.Request.Clone(w.Request.Context()), Response: w.Response.Clone(),
+	clone := &APIWrapper{ID: w.ID, Request: w.Request.Clone(w.Request.Context()), Response: w.Response.Clone(),
 		Claims: w.Claims, Rule: w.Rule, Metrics: w.Metrics, Err: w.Err, RealIP: w.RealIP,
-		Tags: w.Tags, ApplyHeaders: w.ApplyHeaders, Hijacked: w.Hijacked}
+		Tags: w.Tags, ApplyHeaders: w.ApplyHeaders, Variant: w.Variant, Hijacked: w.Hijacked}
+	// the clones are used by the sidecars, which outlive the transaction. Their context is therefore detached from
+	// the transaction, and has a deadline of its own
+	clone.Context = context.WithoutCancel(w.GetContext())
+	if w.Rule != nil && w.Rule._timeout > 0 {
+		clone.Context, clone.cancel = context.WithTimeout(clone.Context, w.Rule._timeout)
+	}
+	return clone
 }
 
 // ExpandRequestIfNeeded determines whether the various transformers and sidecars configured for the route need the
 // request expanded. If so, it expands it
-func (w *APIWrapper) ExpandRequestIfNeeded() {
-	if w.Rule.Request._transformers.ShouldExpandRequest(); w.Rule.Response._transformers.ShouldExpandRequest() ||
+func (w *APIWrapper) ExpandRequestIfNeeded() error {
+	if w.Rule.Request._transformers.ShouldExpandRequest() || w.Rule.Response._transformers.ShouldExpandRequest() ||
 		w.Rule.Request._sidecars.ShouldExpandRequest() ||
 		w.Rule.Response._sidecars.ShouldExpandRequest() {
-		w.ExpandRequest()
+		return w.ExpandRequest()
 	}
+	return nil
 }
 
 // ExpandResponseIfNeeded determines whether the various transformers and sidecars configured for the route need the
@@ -101,28 +136,78 @@ func (w *APIWrapper) ExpandResponseIfNeeded() {
 	}
 }
 
-// ExpandRequest will turn the Request body into a byte array, stored in the APIWrapper itself
-func (w *APIWrapper) ExpandRequest() {
-	if len(w.Request.ExpandedBody) == 0 && w.Request.Body != nil {
-		rawBody, _ := io.ReadAll(w.Request.Body)
+// IsStreamingResponse returns true if the response is a stream, either because the rule says so or because it's a
+// Server-Sent Events stream. Streaming responses are flushed to the client as they're read and never expanded
+func (w *APIWrapper) IsStreamingResponse() bool {
+	return w.Rule.Streaming || isEventStream(w.Response.Header.Get("content-type"))
+}
+
+// LimitRequestBody will reject a request whose declared content length exceeds the maximum body size of the rule.
+// Requests that pass the check get their body capped, so that undeclared lengths will fail on read
+func (w *APIWrapper) LimitRequestBody() error {
+	maxBodySize := w.Rule.GetMaxBodySize()
+	if maxBodySize <= 0 || w.Request.Body == nil {
+		return nil
+	}
+	if w.Request.ContentLength > maxBodySize {
+		return errors.New("body_too_large")
+	}
+	w.Request.Body = http.MaxBytesReader(w.ResponseWriter, w.Request.Body, maxBodySize)
+	return nil
+}
+
+// ExpandRequest will turn the Request body into a byte array, stored in the APIWrapper itself.
+// If the body is larger than the maximum expand size, the body is left to stream untouched, and the wrapper is tagged
+// with `request_not_expanded`. The body is expanded once, further calls do nothing
+func (w *APIWrapper) ExpandRequest() error {
+	if w.Request.ExpandedBody == nil && w.Request.Body != nil && !stringInArray("request_not_expanded", w.Tags) {
+		maxExpandSize := w.Rule.GetMaxExpandSize()
+		rawBody, tooLarge, err := readAtMost(w.Request.Body, maxExpandSize)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return errors.New("body_too_large")
+			}
+			return err
+		}
+		if tooLarge {
+			w.Request.Body = rewindBody(rawBody, w.Request.Body)
+			w.Tags = append(w.Tags, "request_not_expanded")
+			return nil
+		}
 		rawReader := bytes.NewReader(rawBody)
 		if IsGZIPHeader(w.Request.TransferEncoding) {
 			gzipReader, _ := gzip.NewReader(rawReader)
-			w.Request.ExpandedBody, _ = io.ReadAll(gzipReader)
+			w.Request.ExpandedBody, tooLarge, _ = readAtMost(gzipReader, maxExpandSize)
+			// we don't want a compressed payload to bypass the limit, so if the decompressed body is too large,
+			// we throw it away
+			if tooLarge {
+				w.Request.ExpandedBody = nil
+				w.Tags = append(w.Tags, "request_not_expanded")
+			}
 		} else {
 			w.Request.ExpandedBody, _ = io.ReadAll(rawReader)
 		}
 		w.Request.Body = io.NopCloser(bytes.NewReader(rawBody))
 	}
+	return nil
 }
 
-// ExpandResponse will turn the Response body into a byte array, stored in the APIWrapper itself
+// ExpandResponse will turn the Response body into a byte array, stored in the APIWrapper itself.
+// If the body is larger than the maximum expand size, the body is left to stream untouched, and the wrapper is tagged
+// with `response_not_expanded`
 func (w *APIWrapper) ExpandResponse() {
 	if len(w.Response.ExpandedBody) == 0 && w.Response.Body != nil {
-		rawBody, err := io.ReadAll(w.Response.Body)
+		maxExpandSize := w.Rule.GetMaxExpandSize()
+		rawBody, tooLarge, err := readAtMost(w.Response.Body, maxExpandSize)
 		if err != nil {
 			log.LogErr("could not read from response body stream", err, w, log.Warn)
 		}
+		if tooLarge {
+			w.Response.Body = rewindBody(rawBody, w.Response.Body)
+			w.Tags = append(w.Tags, "response_not_expanded")
+			return
+		}
 		if rawBody != nil && len(rawBody) > 0 {
 			rawReader := bytes.NewReader(rawBody)
 			if w.Response.Uncompressed {
@@ -133,7 +218,11 @@ func (w *APIWrapper) ExpandResponse() {
 			} else {
 				gzipReader, err := gzip.NewReader(rawReader)
 				if err == nil {
-					w.Response.ExpandedBody, _ = io.ReadAll(gzipReader)
+					w.Response.ExpandedBody, tooLarge, _ = readAtMost(gzipReader, maxExpandSize)
+					if tooLarge {
+						w.Response.ExpandedBody = nil
+						w.Tags = append(w.Tags, "response_not_expanded")
+					}
 				} else {
 					log.LogErr("could not decompress response body. Falling back to uncompressed", err, w, log.Warn)
 					w.Response.Uncompressed = true
@@ -182,6 +271,11 @@ func (m *APIMetrics) Transaction() int64 {
 	return m.TransactionEnd.Sub(m.TransactionStart).Milliseconds()
 }
 
+// Upstream will return the duration of the trip to the origin in milliseconds
+func (m *APIMetrics) Upstream() int64 {
+	return m.ResTransStart.Sub(m.ReqTransEnd).Milliseconds()
+}
+
 // ReqTransformation will return the duration of the request transformation in milliseconds
 func (m *APIMetrics) ReqTransformation() int64 {
 	return m.ReqTransEnd.Sub(m.ReqTransStart).Milliseconds()
@@ -192,9 +286,23 @@ func (m *APIMetrics) ResTransformation() int64 {
 	return m.ResTransEnd.Sub(m.ResTransStart).Milliseconds()
 }
 
-// ReqWithContext will add the RedPlant context to the provided request
+// ReqWithContext will add the RedPlant context to the provided request. If the rule has a timeout, the context will
+// also carry the deadline for the whole transaction. The deadline is a timer rather than a context deadline, so that
+// it can be lifted for the transactions meant to outlive it
 func ReqWithContext(req *http.Request, responseWriter http.ResponseWriter, rule *Rule) *http.Request {
 	ctx := req.Context()
+	var cancel context.CancelFunc
+	var deadline *time.Timer
+	if rule != nil && rule._timeout > 0 {
+		var cancelCause context.CancelCauseFunc
+		ctx, cancelCause = context.WithCancelCause(ctx)
+		deadline = time.AfterFunc(rule._timeout, func() {
+			cancelCause(context.DeadlineExceeded)
+		})
+		cancel = func() {
+			cancelCause(nil)
+		}
+	}
 	wrapper := &APIWrapper{Rule: rule, Metrics: &APIMetrics{TransactionStart: time.Now()},
 		ID:             uuid.New().String(),
 		Context:        ctx,
@@ -202,7 +310,9 @@ func ReqWithContext(req *http.Request, responseWriter http.ResponseWriter, rule
 		Variables:      &config.Variables,
 		RealIP:         addresser.RealIP(req),
 		ResponseWriter: responseWriter,
-		ApplyHeaders:   http.Header{}}
+		ApplyHeaders:   http.Header{},
+		cancel:         cancel,
+		deadline:       deadline}
 	un, _, ok := req.BasicAuth()
 	if ok {
 		wrapper.Username = un
@@ -213,6 +323,36 @@ func ReqWithContext(req *http.Request, responseWriter http.ResponseWriter, rule
 	return req
 }
 
+// Release will release the resources associated to the transaction deadline, if any
+func (w *APIWrapper) Release() {
+	w.LiftDeadline()
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// LiftDeadline will stop the transaction deadline, if any, for the transactions meant to outlive it, such as
+// websockets and streaming responses. A deadline that has already been exceeded is not lifted
+func (w *APIWrapper) LiftDeadline() {
+	if w.deadline != nil {
+		w.deadline.Stop()
+	}
+}
+
+// GetContext will return the context of the transaction, or the background context if the wrapper has none, as it
+// happens to wrappers built outside the proxy
+func (w *APIWrapper) GetContext() context.Context {
+	if w.Context == nil {
+		return context.Background()
+	}
+	return w.Context
+}
+
+// TimedOut will return true if the transaction deadline has been exceeded
+func (w *APIWrapper) TimedOut() bool {
+	return w.Context != nil && errors.Is(context.Cause(w.Context), context.DeadlineExceeded)
+}
+
 // GetWrapper will extract the wrapper from the context in the request
 func GetWrapper(req *http.Request) *APIWrapper {
 	wrapper := req.Context().Value("wrapper")